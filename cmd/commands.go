@@ -1,13 +1,23 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/spf13/cobra"
+	"imagetag/internal/cache"
+	"imagetag/internal/fetch"
+	"imagetag/internal/imaging"
+	"imagetag/internal/jobs"
+	"imagetag/internal/quarantine"
 	"imagetag/internal/tagging"
 	"imagetag/internal/web"
+	"imagetag/keythrottle"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 var rootCmd = &cobra.Command{
@@ -21,12 +31,124 @@ var rootCmd = &cobra.Command{
 		if outputPath == "" {
 			log.Panicln("IMAGETAG_OUTPUT environment variable not set")
 		}
-		i := tagging.BuildAndStart(inputPath, outputPath)
-		r := web.BuildRouter(i)
-		err := http.ListenAndServe(":8080", r)
+		config := tagging.Config{
+			InputPath:  inputPath,
+			OutputPath: outputPath,
+			Models:     envList("IMAGETAG_MODELS"),
+		}
+		for _, name := range envList("IMAGETAG_NATIVE_FORMATS") {
+			format, err := imaging.ParseFormat(name)
+			if err != nil {
+				log.Panicf("invalid IMAGETAG_NATIVE_FORMATS: %s", err)
+			}
+			config.NativeFormats = append(config.NativeFormats, format)
+		}
+		config.Preprocessing, config.ModelPreprocessing = envPreprocessing()
+		config.Limits = imaging.Limits{
+			MaxFileSize:  envInt("IMAGETAG_MAX_FILE_SIZE", imaging.DefaultMaxFileSize),
+			MaxPixels:    envInt("IMAGETAG_MAX_PIXELS", imaging.DefaultMaxPixels),
+			MaxDimension: envInt("IMAGETAG_MAX_DIMENSION", imaging.DefaultMaxDimension),
+			FullDecode:   envBool("IMAGETAG_FULL_DECODE", false),
+		}
+		config.KeepMetadata = envBool("IMAGETAG_KEEP_METADATA", false)
+		if quarantinePath := os.Getenv("IMAGETAG_QUARANTINE"); quarantinePath != "" {
+			q, err := quarantine.BuildQuarantine(quarantinePath)
+			if err != nil {
+				log.Panicln(err)
+			}
+			config.Quarantine = q
+		}
+		interrogator := tagging.Build(config)
+		resultCache, err := cache.BuildCache(
+			envInt("IMAGETAG_CACHE_ENTRIES", cache.DefaultMaxEntries),
+			envDuration("IMAGETAG_CACHE_TTL", cache.DefaultTTL),
+			os.Getenv("IMAGETAG_CACHE_DIR"),
+		)
 		if err != nil {
 			log.Panicln(err)
 		}
+		var tagger tagging.Tagger = cache.BuildCachingTagger(interrogator, resultCache)
+		jobStore := jobs.BuildStore(
+			tagger,
+			envDuration("IMAGETAG_JOB_RETENTION", jobs.DefaultRetention),
+			envDuration("IMAGETAG_JOB_MAX_HOLD", jobs.DefaultMaxHold),
+		)
+
+		policy := tagging.ReconcilePolicy{
+			Input:  envPolicy("IMAGETAG_RECONCILE_INPUT", tagging.POLICY_ADOPT),
+			Output: envPolicy("IMAGETAG_RECONCILE_OUTPUT", tagging.POLICY_ADOPT),
+		}
+		if _, err := interrogator.Reconcile(policy, jobStore); err != nil {
+			log.Panicln(err)
+		}
+		if err := interrogator.Start(); err != nil {
+			log.Panicln(err)
+		}
+		maxUploadSize := int64(envInt("IMAGETAG_MAX_UPLOAD_SIZE", web.DefaultMaxUploadSize))
+		fetcher := fetch.BuildFetcher(fetch.Config{
+			MaxSize:      maxUploadSize,
+			Timeout:      envDuration("IMAGETAG_FETCH_TIMEOUT", fetch.DefaultTimeout),
+			MaxRedirects: envInt("IMAGETAG_FETCH_MAX_REDIRECTS", fetch.DefaultMaxRedirects),
+			AllowPrivate: envBool("IMAGETAG_FETCH_ALLOW_PRIVATE", false),
+		})
+		keyStore := keythrottle.BuildKeyStore()
+		spoolDir := os.Getenv("IMAGETAG_SPOOL_DIR")
+		if spoolDir == "" {
+			spoolDir = inputPath
+		}
+		authPath := os.Getenv("IMAGETAG_AUTH_FILE")
+		if authPath == "" {
+			authPath = keythrottle.DefaultAuthFile
+		}
+		authPolicy := envAuthPolicy("IMAGETAG_AUTH_POLICY", keythrottle.AUTH_ALLOW)
+		authWatcher := keythrottle.BuildAuthFileWatcher(keyStore, authPath)
+		// the other policies hold back every request when there are no keys, so the keys must be there from the start
+		authWatcher.Required = authPolicy != keythrottle.AUTH_ALLOW
+		if err := authWatcher.Start(); err != nil {
+			log.Panicln(err)
+		}
+		defer authWatcher.Stop()
+		r := web.BuildRouter(web.Config{
+			Tagger:        tagger,
+			JobStore:      jobStore,
+			Cache:         resultCache,
+			AdminKey:      os.Getenv("IMAGETAG_ADMIN_KEY"),
+			SpoolDir:      spoolDir,
+			MaxUploadSize: maxUploadSize,
+			MaxBatchItems: envInt("IMAGETAG_MAX_BATCH_ITEMS", web.DefaultMaxBatchItems),
+			Fetcher:       fetcher,
+			Scheduler: keythrottle.BuildScheduler(keythrottle.SchedulerConfig{
+				MaxConcurrent: envInt("IMAGETAG_MAX_CONCURRENT_JOBS", keythrottle.DefaultMaxConcurrent),
+				Weights:       envTierWeights("IMAGETAG_TIER_WEIGHTS"),
+				MaxWait:       envDuration("IMAGETAG_MAX_QUEUE_WAIT", keythrottle.DefaultMaxWait),
+			}),
+			RateLimiter: keythrottle.BuildRateLimiter(keythrottle.RateLimiterConfig{
+				Limits:      envRateLimits("IMAGETAG_RATE_LIMITS"),
+				IdleTimeout: envDuration("IMAGETAG_RATE_LIMIT_IDLE_TIMEOUT", keythrottle.DefaultIdleTimeout),
+			}),
+			Auth: keythrottle.AuthConfig{
+				KeyStore:                   keyStore,
+				Policy:                     authPolicy,
+				UnauthenticatedConcurrency: envInt("IMAGETAG_UNAUTHENTICATED_CONCURRENCY", keythrottle.DefaultUnauthenticatedConcurrency),
+			},
+		})
+		server := &http.Server{Addr: ":8080", Handler: r}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go func() {
+			<-ctx.Done()
+			log.Println("shutting down")
+			if err := server.Shutdown(context.Background()); err != nil {
+				log.Printf("could not shut down server: %s", err)
+			}
+		}()
+
+		err = server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Panicln(err)
+		}
+		interrogator.Stop()
 	},
 }
 
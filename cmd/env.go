@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"image/color"
+	"imagetag/internal/imaging"
+	"imagetag/internal/tagging"
+	"imagetag/keythrottle"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envList reads a comma separated list from the environment variable, skipping empty items.
+func envList(name string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// envDuration reads a duration such as 10m from the environment variable, or returns the fallback when it's not set.
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Panicf("invalid %s: %s", name, err)
+	}
+	return d
+}
+
+// envInt reads an integer from the environment variable, or returns the fallback when it's not set.
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Panicf("invalid %s: %s", name, err)
+	}
+	return i
+}
+
+// envBool reads true or false from the environment variable, or returns the fallback when it's not set.
+func envBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Panicf("invalid %s: %s", name, err)
+	}
+	return b
+}
+
+func envPolicy(name string, fallback tagging.Policy) tagging.Policy {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	policy, err := tagging.ParsePolicy(value)
+	if err != nil {
+		log.Panicf("invalid %s: %s", name, err)
+	}
+	return policy
+}
+
+func envAuthPolicy(name string, fallback keythrottle.AuthPolicy) keythrottle.AuthPolicy {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	policy, err := keythrottle.ParseAuthPolicy(value)
+	if err != nil {
+		log.Panicf("invalid %s: %s", name, err)
+	}
+	return policy
+}
+
+// envTierWeights reads the scheduler's tier weights as tier=weight,tier=weight, or returns nil for the defaults when
+// it's not set.
+func envTierWeights(name string) map[keythrottle.Tier]int {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	weights, err := keythrottle.ParseTierWeights(value)
+	if err != nil {
+		log.Panicf("invalid %s: %s", name, err)
+	}
+	return weights
+}
+
+// envRateLimits reads the rate limits as tier=rate:burst,tier=rate:burst, or returns nil for the defaults when it's not
+// set.
+func envRateLimits(name string) map[keythrottle.Tier]keythrottle.RateLimit {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	limits, err := keythrottle.ParseRateLimits(value)
+	if err != nil {
+		log.Panicf("invalid %s: %s", name, err)
+	}
+	return limits
+}
+
+// envPreprocessing reads the default preprocessing steps, and the overrides for individual models as
+// model=steps;model=steps.
+func envPreprocessing() (imaging.Preprocessing, map[string]imaging.Preprocessing) {
+	maxEdge := envInt("IMAGETAG_MAX_EDGE", imaging.DefaultMaxEdge)
+	var background color.Color = color.White
+	if value := os.Getenv("IMAGETAG_BACKGROUND"); value != "" {
+		c, err := imaging.ParseColor(value)
+		if err != nil {
+			log.Panicf("invalid IMAGETAG_BACKGROUND: %s", err)
+		}
+		background = c
+	}
+
+	steps, ok := os.LookupEnv("IMAGETAG_PREPROCESS")
+	if !ok {
+		steps = "orient,downscale,flatten"
+	}
+	preprocessing, err := imaging.ParsePreprocessing(steps, maxEdge, background)
+	if err != nil {
+		log.Panicf("invalid IMAGETAG_PREPROCESS: %s", err)
+	}
+
+	models := map[string]imaging.Preprocessing{}
+	for _, item := range strings.Split(os.Getenv("IMAGETAG_MODEL_PREPROCESS"), ";") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		model, modelSteps, found := strings.Cut(item, "=")
+		if !found {
+			log.Panicf("invalid IMAGETAG_MODEL_PREPROCESS: expected model=steps, got %s", item)
+		}
+		p, err := imaging.ParsePreprocessing(modelSteps, maxEdge, background)
+		if err != nil {
+			log.Panicf("invalid IMAGETAG_MODEL_PREPROCESS: %s", err)
+		}
+		models[strings.TrimSpace(model)] = p
+	}
+	return preprocessing, models
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"imagetag/internal/quarantine"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+var purgeOlderThan time.Duration
+
+var quarantineCmd = &cobra.Command{
+	Use:   "quarantine",
+	Short: "Inspect result files which couldn't be delivered",
+}
+
+var quarantineListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List quarantined result files",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		q, err := openQuarantine()
+		if err != nil {
+			return err
+		}
+		entries, err := q.List()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "QUARANTINED AT\tREASON\tFILE\tDETAIL")
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", entry.QuarantinedAt.Format(time.RFC3339), entry.Reason, entry.Filename, entry.Detail)
+		}
+		return w.Flush()
+	},
+}
+
+var quarantinePurgeCmd = &cobra.Command{
+	Use:   "purge",
+	Short: "Remove quarantined result files",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		q, err := openQuarantine()
+		if err != nil {
+			return err
+		}
+		purged, err := q.Purge(time.Now().Add(-purgeOlderThan))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("purged %d files\n", purged)
+		return nil
+	},
+}
+
+func openQuarantine() (*quarantine.Quarantine, error) {
+	quarantinePath := os.Getenv("IMAGETAG_QUARANTINE")
+	if quarantinePath == "" {
+		return nil, fmt.Errorf("IMAGETAG_QUARANTINE environment variable not set")
+	}
+	return quarantine.BuildQuarantine(quarantinePath)
+}
+
+func init() {
+	quarantinePurgeCmd.Flags().DurationVar(&purgeOlderThan, "older-than", 0, "only purge files quarantined longer ago than this, eg 24h")
+	quarantineCmd.AddCommand(quarantineListCmd, quarantinePurgeCmd)
+	rootCmd.AddCommand(quarantineCmd)
+}
@@ -3,12 +3,15 @@ module imagetag
 go 1.23
 
 require (
-	github.com/fsnotify/fsnotify v1.8.0 // indirect
-	github.com/go-chi/chi/v5 v5.2.0 // indirect
-	github.com/google/uuid v1.6.0 // indirect
+	github.com/fsnotify/fsnotify v1.8.0
+	github.com/go-chi/chi/v5 v5.2.0
+	github.com/google/uuid v1.6.0
+	github.com/spf13/cobra v1.8.1
+	golang.org/x/image v0.23.0
+)
+
+require (
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
-	github.com/spf13/cobra v1.8.1 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/stretchr/testify v1.10.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 )
@@ -0,0 +1,208 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"imagetag/internal/imaging"
+	"imagetag/internal/tagging"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultMaxEntries = 1000
+const DefaultTTL = 24 * time.Hour
+
+// storedResult is a cached result, as held in memory and persisted to disk.
+type storedResult struct {
+	Key        string         `json:"key"`
+	Tags       []string       `json:"tags"`
+	TagDetails []tagging.Tag  `json:"tag_details"`
+	Model      string         `json:"model"`
+	Format     imaging.Format `json:"format"`
+	StoredAt   time.Time      `json:"stored_at"`
+}
+
+// Cache holds successful results by key, evicting the least recently used beyond MaxEntries and any older than the
+// TTL.  When Dir is set every entry is mirrored to a file there, so that the cache survives a restart.
+type Cache struct {
+	MaxEntries int
+	TTL        time.Duration
+	Dir        string
+	entries    map[string]*list.Element
+	// order holds the entries from most to least recently used.
+	order *list.List
+	mutex sync.Mutex
+}
+
+// BuildCache builds a cache, loading any entries persisted in dir.  dir may be empty to only cache in memory.
+func BuildCache(maxEntries int, ttl time.Duration, dir string) (*Cache, error) {
+	if maxEntries <= 0 {
+		maxEntries = DefaultMaxEntries
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	c := &Cache{
+		MaxEntries: maxEntries,
+		TTL:        ttl,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+	if dir != "" {
+		c.Dir = filepath.Clean(dir)
+		if err := os.MkdirAll(c.Dir, 0755); err != nil {
+			return nil, fmt.Errorf("could not create cache directory: %s", err)
+		}
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Get returns the cached result for the key, if there's one which hasn't expired.
+func (c *Cache) Get(key string) (tagging.JobResult, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, exists := c.entries[key]
+	if !exists {
+		return tagging.JobResult{}, false
+	}
+	stored := element.Value.(storedResult)
+	if time.Since(stored.StoredAt) > c.TTL {
+		c.remove(element)
+		return tagging.JobResult{}, false
+	}
+	c.order.MoveToFront(element)
+	return tagging.JobResult{
+		Tags:       stored.Tags,
+		TagDetails: stored.TagDetails,
+		Model:      stored.Model,
+		Format:     stored.Format,
+	}, true
+}
+
+// Put caches the result.  Failed results aren't cached.
+func (c *Cache) Put(key string, result tagging.JobResult) {
+	if result.Error != nil {
+		return
+	}
+	stored := storedResult{
+		Key:        key,
+		Tags:       result.Tags,
+		TagDetails: result.TagDetails,
+		Model:      result.Model,
+		Format:     result.Format,
+		StoredAt:   time.Now(),
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.add(stored)
+	c.persist(stored)
+}
+
+// Len returns the number of cached results, including any which have expired but not yet been evicted.
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.order.Len()
+}
+
+// Purge removes every cached result, returning how many were removed.
+func (c *Cache) Purge() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	purged := c.order.Len()
+	for element := c.order.Front(); element != nil; element = c.order.Front() {
+		c.remove(element)
+	}
+	return purged
+}
+
+// add inserts the entry, evicting beyond MaxEntries.  The caller must hold the mutex.
+func (c *Cache) add(stored storedResult) {
+	if element, exists := c.entries[stored.Key]; exists {
+		element.Value = stored
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[stored.Key] = c.order.PushFront(stored)
+	for c.order.Len() > c.MaxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove removes the entry from memory and disk.  The caller must hold the mutex.
+func (c *Cache) remove(element *list.Element) {
+	stored := element.Value.(storedResult)
+	c.order.Remove(element)
+	delete(c.entries, stored.Key)
+	if c.Dir != "" {
+		if err := os.Remove(c.entryPath(stored.Key)); err != nil && !os.IsNotExist(err) {
+			log.Printf("could not remove cache file: %s", err)
+		}
+	}
+}
+
+func (c *Cache) persist(stored storedResult) {
+	if c.Dir == "" {
+		return
+	}
+	content, err := json.Marshal(stored)
+	if err != nil {
+		log.Printf("could not encode cache entry: %s", err)
+		return
+	}
+	// write then rename, so that a crash never leaves a partial entry to be loaded
+	tmpPath := c.entryPath(stored.Key) + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		log.Printf("could not write cache file: %s", err)
+		return
+	}
+	if err := os.Rename(tmpPath, c.entryPath(stored.Key)); err != nil {
+		log.Printf("could not write cache file: %s", err)
+	}
+}
+
+// load reads entries persisted by a previous run, discarding expired and unreadable ones.
+func (c *Cache) load() error {
+	dirEntries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return fmt.Errorf("could not read cache directory: %s", err)
+	}
+	loaded := []storedResult{}
+	for _, dirEntry := range dirEntries {
+		filePath := filepath.Join(c.Dir, dirEntry.Name())
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), ".json") {
+			continue
+		}
+		content, err := os.ReadFile(filePath)
+		var stored storedResult
+		if err == nil {
+			err = json.Unmarshal(content, &stored)
+		}
+		if err != nil || time.Since(stored.StoredAt) > c.TTL || c.entryPath(stored.Key) != filePath {
+			os.Remove(filePath)
+			continue
+		}
+		loaded = append(loaded, stored)
+	}
+	// add oldest first, so that the newest are kept when there are more than MaxEntries
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].StoredAt.Before(loaded[j].StoredAt)
+	})
+	for _, stored := range loaded {
+		c.add(stored)
+	}
+	return nil
+}
+
+func (c *Cache) entryPath(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"imagetag/internal/tagging"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCache_GetPut(t *testing.T) {
+	tests := map[string]struct {
+		maxEntries int
+		ttl        time.Duration
+		put        []string
+		get        string
+		wait       time.Duration
+		wantHit    bool
+	}{
+		"hit": {
+			maxEntries: 2,
+			ttl:        time.Minute,
+			put:        []string{"a"},
+			get:        "a",
+			wantHit:    true,
+		},
+		"miss": {
+			maxEntries: 2,
+			ttl:        time.Minute,
+			put:        []string{"a"},
+			get:        "b",
+			wantHit:    false,
+		},
+		"evicted least recently used": {
+			maxEntries: 2,
+			ttl:        time.Minute,
+			put:        []string{"a", "b", "c"},
+			get:        "a",
+			wantHit:    false,
+		},
+		"kept most recently used": {
+			maxEntries: 2,
+			ttl:        time.Minute,
+			put:        []string{"a", "b", "c"},
+			get:        "c",
+			wantHit:    true,
+		},
+		"expired": {
+			maxEntries: 2,
+			ttl:        10 * time.Millisecond,
+			put:        []string{"a"},
+			get:        "a",
+			wait:       30 * time.Millisecond,
+			wantHit:    false,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			c, err := BuildCache(test.maxEntries, test.ttl, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range test.put {
+				c.Put(key, tagging.JobResult{Tags: []string{key}})
+			}
+			time.Sleep(test.wait)
+
+			result, hit := c.Get(test.get)
+			if hit != test.wantHit {
+				t.Fatalf("got hit %v, want %v", hit, test.wantHit)
+			}
+			if hit && (len(result.Tags) != 1 || result.Tags[0] != test.get) {
+				t.Errorf("got %+v", result)
+			}
+		})
+	}
+}
+
+func TestCache_PutError(t *testing.T) {
+	c, err := BuildCache(2, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Put("a", tagging.JobResult{Error: tagging.BackendError{Code: tagging.ERROR_BACKEND}})
+
+	if _, hit := c.Get("a"); hit {
+		t.Error("failed results should not be cached")
+	}
+}
+
+func TestCache_Persistence(t *testing.T) {
+	dir := t.TempDir()
+	c, err := BuildCache(2, time.Minute, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Put("a", tagging.JobResult{Tags: []string{"cat"}, Model: "model-a"})
+	c.Put("b", tagging.JobResult{Tags: []string{"dog"}, Model: "model-a"})
+	c.Put("c", tagging.JobResult{Tags: []string{"bird"}, Model: "model-a"})
+
+	reloaded, err := BuildCache(2, time.Minute, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Len() != 2 {
+		t.Errorf("got %d entries, want 2", reloaded.Len())
+	}
+	if result, hit := reloaded.Get("c"); !hit || result.Tags[0] != "bird" || result.Model != "model-a" {
+		t.Errorf("got %+v, %v", result, hit)
+	}
+	if _, hit := reloaded.Get("a"); hit {
+		t.Error("expected evicted entry to stay evicted")
+	}
+
+	if purged := reloaded.Purge(); purged != 2 {
+		t.Errorf("got %d purged, want 2", purged)
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("got %d files after purge, want 0", len(files))
+	}
+}
@@ -0,0 +1,188 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/uuid"
+	"imagetag/internal/tagging"
+	"io"
+	"mime/multipart"
+	"sync"
+	"time"
+)
+
+var _ tagging.IdentifiedTagger = (*CachingTagger)(nil)
+
+// CachingTagger answers repeat submissions of the same image and model from the cache, only passing new images on
+// to the wrapped Tagger.  Submissions of an image which is already being tagged wait on that job rather than
+// submitting another.
+type CachingTagger struct {
+	tagger tagging.Tagger
+	cache  *Cache
+	// flights holds the jobs in progress by cache key
+	flights     map[string]*flight
+	flightMutex sync.Mutex
+}
+
+// flight is a job in progress, whose result is fanned out to every waiter.
+type flight struct {
+	key string
+	// waiters holds each waiter's results channel by the job id it was given
+	waiters map[string]chan tagging.JobResult
+	// cancelJob cancels the wrapped Tagger's job, it's nil until the job has been submitted
+	cancelJob func()
+	// abandoned is closed when every waiter has cancelled
+	abandoned chan struct{}
+}
+
+func BuildCachingTagger(tagger tagging.Tagger, cache *Cache) *CachingTagger {
+	return &CachingTagger{
+		tagger:  tagger,
+		cache:   cache,
+		flights: make(map[string]*flight),
+	}
+}
+
+func (c *CachingTagger) TagImage(imageFile multipart.File, model string) (tagging.Submission, error) {
+	return c.TagImageAs(uuid.New().String(), imageFile, model)
+}
+
+// TagImageAs gives the job the id whether it's answered from the cache, waits on another job or is passed on.  The
+// wrapped Tagger's job only has the same id if it's an IdentifiedTagger too.
+func (c *CachingTagger) TagImageAs(id string, imageFile multipart.File, model string) (tagging.Submission, error) {
+	// the model is checked before the cache, which may hold results for models no longer allowed
+	model, err := tagging.ResolveModel(c.tagger.AllowedModels(), model)
+	if err != nil {
+		return tagging.Submission{}, err
+	}
+	key, err := hashImage(imageFile, model)
+	if err != nil {
+		return tagging.Submission{}, err
+	}
+
+	if result, hit := c.cache.Get(key); hit {
+		now := time.Now()
+		result.JobId = id
+		result.SubmittedAt = now
+		result.CompletedAt = now
+		result.Cached = true
+		results := make(chan tagging.JobResult, 1)
+		results <- result
+		return tagging.Submission{JobId: result.JobId, Results: results, Cancel: func() {}}, nil
+	}
+
+	c.flightMutex.Lock()
+	if f, exists := c.flights[key]; exists {
+		submission := c.wait(f, id)
+		c.flightMutex.Unlock()
+		return submission, nil
+	}
+	f := &flight{
+		key:       key,
+		waiters:   make(map[string]chan tagging.JobResult),
+		abandoned: make(chan struct{}),
+	}
+	c.flights[key] = f
+	c.flightMutex.Unlock()
+
+	var inner tagging.Submission
+	if identified, ok := c.tagger.(tagging.IdentifiedTagger); ok {
+		inner, err = identified.TagImageAs(id, imageFile, model)
+	} else {
+		inner, err = c.tagger.TagImage(imageFile, model)
+	}
+	if err != nil {
+		c.land(f, tagging.JobResult{Error: err})
+		return inner, err
+	}
+	c.flightMutex.Lock()
+	submission := c.wait(f, id)
+	f.cancelJob = inner.Cancel
+	c.flightMutex.Unlock()
+
+	go func() {
+		select {
+		case result := <-inner.Results:
+			c.cache.Put(key, result)
+			c.land(f, result)
+		case <-f.abandoned:
+		}
+	}()
+	return submission, nil
+}
+
+func (c *CachingTagger) Validate(imageFile multipart.File, model string) error {
+	return c.tagger.Validate(imageFile, model)
+}
+
+func (c *CachingTagger) AllowedModels() []string {
+	return c.tagger.AllowedModels()
+}
+
+// wait adds a waiter to the flight.  The caller must hold flightMutex.
+func (c *CachingTagger) wait(f *flight, jobId string) tagging.Submission {
+	results := make(chan tagging.JobResult, 1)
+	f.waiters[jobId] = results
+	return tagging.Submission{
+		JobId:   jobId,
+		Results: results,
+		Cancel:  func() { c.leave(f, jobId) },
+	}
+}
+
+// leave removes a waiter from the flight.  The job is only cancelled once nobody is waiting on it.
+func (c *CachingTagger) leave(f *flight, jobId string) {
+	c.flightMutex.Lock()
+	defer c.flightMutex.Unlock()
+	if _, exists := f.waiters[jobId]; !exists {
+		return
+	}
+	delete(f.waiters, jobId)
+	if len(f.waiters) > 0 || f.cancelJob == nil {
+		return
+	}
+	if c.flights[f.key] == f {
+		delete(c.flights, f.key)
+	}
+	close(f.abandoned)
+	f.cancelJob()
+}
+
+// land sends the result to every waiter and ends the flight.
+func (c *CachingTagger) land(f *flight, result tagging.JobResult) {
+	c.flightMutex.Lock()
+	defer c.flightMutex.Unlock()
+	if c.flights[f.key] == f {
+		delete(c.flights, f.key)
+	}
+	for jobId, results := range f.waiters {
+		waiterResult := result
+		waiterResult.JobId = jobId
+		results <- waiterResult
+	}
+	f.waiters = map[string]chan tagging.JobResult{}
+}
+
+// hashImage returns the cache key for the image and model, leaving the image rewound for reading.  The image's SHA-256
+// is reused if it was computed as it was received.
+func hashImage(imageFile multipart.File, model string) (string, error) {
+	var imageSum []byte
+	if hashed, ok := imageFile.(tagging.HashedFile); ok {
+		imageSum = hashed.Sha256()
+	} else {
+		imageHash := sha256.New()
+		if _, err := io.Copy(imageHash, imageFile); err != nil {
+			return "", fmt.Errorf("could not hash image: %s", err)
+		}
+		if _, err := imageFile.Seek(0, io.SeekStart); err != nil {
+			return "", fmt.Errorf("failed to reset file pointer: %v", err)
+		}
+		imageSum = imageHash.Sum(nil)
+	}
+	h := sha256.New()
+	h.Write([]byte(model))
+	h.Write([]byte{0})
+	h.Write(imageSum)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,276 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"imagetag/internal/tagging"
+	"io"
+	"mime/multipart"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeTagger struct {
+	submitted []string
+}
+
+func (f *fakeTagger) TagImage(imageFile multipart.File, model string) (tagging.Submission, error) {
+	content, err := io.ReadAll(imageFile)
+	if err != nil {
+		return tagging.Submission{}, err
+	}
+	f.submitted = append(f.submitted, string(content))
+	results := make(chan tagging.JobResult, 1)
+	results <- tagging.JobResult{JobId: "backend", Tags: []string{string(content)}, Model: model}
+	return tagging.Submission{JobId: "backend", Results: results, Cancel: func() {}}, nil
+}
+
+func (f *fakeTagger) Validate(imageFile multipart.File, model string) error {
+	return nil
+}
+
+func (f *fakeTagger) AllowedModels() []string {
+	return []string{"model-a", "model-b"}
+}
+
+// memoryFile is an in-memory multipart.File.
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+func tagAndWait(t *testing.T, tagger tagging.Tagger, content string, model string) tagging.JobResult {
+	t.Helper()
+	submission, err := tagger.TagImage(memoryFile{bytes.NewReader([]byte(content))}, model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case result := <-submission.Results:
+		if result.JobId != submission.JobId {
+			t.Errorf("got result job id %s, want %s", result.JobId, submission.JobId)
+		}
+		return result
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for result")
+		return tagging.JobResult{}
+	}
+}
+
+func TestCachingTagger_TagImage(t *testing.T) {
+	c, err := BuildCache(10, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &fakeTagger{}
+	tagger := BuildCachingTagger(inner, c)
+
+	first := tagAndWait(t, tagger, "image-1", "")
+	if first.Cached {
+		t.Error("first submission should not be cached")
+	}
+	second := tagAndWait(t, tagger, "image-1", "model-a")
+	if !second.Cached {
+		t.Error("repeat submission with the default model should be cached")
+	}
+	if second.Tags[0] != "image-1" || second.JobId == first.JobId {
+		t.Errorf("got %+v", second)
+	}
+	third := tagAndWait(t, tagger, "image-1", "model-b")
+	if third.Cached {
+		t.Error("another model should not be cached")
+	}
+	tagAndWait(t, tagger, "image-2", "")
+
+	if len(inner.submitted) != 3 {
+		t.Errorf("got %d backend submissions, want 3", len(inner.submitted))
+	}
+	// the image must be rewound after hashing
+	for _, content := range inner.submitted {
+		if content != "image-1" && content != "image-2" {
+			t.Errorf("backend read %q", content)
+		}
+	}
+}
+
+// blockingTagger holds every job until it's released.
+type blockingTagger struct {
+	results   chan tagging.JobResult
+	submitted atomic.Int32
+	cancelled atomic.Int32
+}
+
+func (b *blockingTagger) TagImage(imageFile multipart.File, model string) (tagging.Submission, error) {
+	b.submitted.Add(1)
+	return tagging.Submission{JobId: "backend", Results: b.results, Cancel: func() { b.cancelled.Add(1) }}, nil
+}
+
+func (b *blockingTagger) Validate(imageFile multipart.File, model string) error {
+	return nil
+}
+
+func (b *blockingTagger) AllowedModels() []string {
+	return []string{"model-a"}
+}
+
+func submitAll(t *testing.T, tagger tagging.Tagger, count int) []tagging.Submission {
+	t.Helper()
+	submissions := []tagging.Submission{}
+	for i := 0; i < count; i++ {
+		submission, err := tagger.TagImage(memoryFile{bytes.NewReader([]byte("image-1"))}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		submissions = append(submissions, submission)
+	}
+	return submissions
+}
+
+func TestCachingTagger_TagImageAs(t *testing.T) {
+	c, err := BuildCache(10, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagger := BuildCachingTagger(&fakeTagger{}, c)
+
+	// the job takes the id whether it's passed on or answered from the cache
+	for _, id := range []string{"first", "cached"} {
+		submission, err := tagger.TagImageAs(id, memoryFile{bytes.NewReader([]byte("image-1"))}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if submission.JobId != id {
+			t.Errorf("got job id %s, want %s", submission.JobId, id)
+		}
+		if result := <-submission.Results; result.JobId != id {
+			t.Errorf("got result job id %s, want %s", result.JobId, id)
+		}
+	}
+}
+
+func TestCachingTagger_ModelNotAllowed(t *testing.T) {
+	c, err := BuildCache(10, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagger := &fakeTagger{}
+	caching := BuildCachingTagger(tagger, c)
+	content := memoryFile{bytes.NewReader([]byte("cat"))}
+	key, err := hashImage(content, "model-removed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cached while the model was allowed
+	c.Put(key, tagging.JobResult{Tags: []string{"cat"}})
+
+	_, err = caching.TagImage(content, "model-removed")
+
+	var notAllowed tagging.ModelNotAllowedError
+	if !errors.As(err, &notAllowed) {
+		t.Errorf("got %v, want ModelNotAllowedError", err)
+	}
+}
+
+func TestCachingTagger_Coalesce(t *testing.T) {
+	c, err := BuildCache(10, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &blockingTagger{results: make(chan tagging.JobResult, 1)}
+	tagger := BuildCachingTagger(inner, c)
+
+	submissions := submitAll(t, tagger, 3)
+	if inner.submitted.Load() != 1 {
+		t.Fatalf("got %d backend submissions, want 1", inner.submitted.Load())
+	}
+	// cancelling one waiter leaves the job running for the others
+	submissions[1].Cancel()
+	if inner.cancelled.Load() != 0 {
+		t.Error("job cancelled while others were waiting")
+	}
+
+	inner.results <- tagging.JobResult{JobId: "backend", Tags: []string{"cat"}}
+
+	jobIds := map[string]bool{}
+	for _, i := range []int{0, 2} {
+		select {
+		case result := <-submissions[i].Results:
+			if len(result.Tags) != 1 || result.Tags[0] != "cat" || result.JobId != submissions[i].JobId {
+				t.Errorf("waiter %d got %+v", i, result)
+			}
+			jobIds[result.JobId] = true
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for waiter %d", i)
+		}
+	}
+	if len(jobIds) != 2 {
+		t.Errorf("expected each waiter to have its own job id, got %v", jobIds)
+	}
+	select {
+	case result := <-submissions[1].Results:
+		t.Errorf("cancelled waiter got %+v", result)
+	default:
+	}
+}
+
+func TestCachingTagger_CoalesceCancelAll(t *testing.T) {
+	c, err := BuildCache(10, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner := &blockingTagger{results: make(chan tagging.JobResult, 1)}
+	tagger := BuildCachingTagger(inner, c)
+
+	for _, submission := range submitAll(t, tagger, 2) {
+		submission.Cancel()
+	}
+	if inner.cancelled.Load() != 1 {
+		t.Errorf("got %d cancellations, want 1", inner.cancelled.Load())
+	}
+
+	// a later submission starts a new job
+	submitAll(t, tagger, 1)
+	if inner.submitted.Load() != 2 {
+		t.Errorf("got %d backend submissions, want 2", inner.submitted.Load())
+	}
+}
+
+// hashedFile is a memoryFile which was hashed as it was received.
+type hashedFile struct {
+	memoryFile
+	sum []byte
+}
+
+func (h hashedFile) Sha256() []byte {
+	return h.sum
+}
+
+func TestHashImage_Hashed(t *testing.T) {
+	content := []byte("image-1")
+	sum := sha256.Sum256(content)
+
+	plain, err := hashImage(memoryFile{bytes.NewReader(content)}, "model-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the reader is left unread, so the key must come from the hash alone
+	hashed, err := hashImage(hashedFile{memoryFile{bytes.NewReader(nil)}, sum[:]}, "model-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashed != plain {
+		t.Errorf("got key %s for the hashed file, want %s", hashed, plain)
+	}
+	other, err := hashImage(hashedFile{memoryFile{bytes.NewReader(nil)}, sum[:]}, "model-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == plain {
+		t.Error("got the same key for a different model")
+	}
+}
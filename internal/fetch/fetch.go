@@ -0,0 +1,278 @@
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultMaxSize is the largest image downloaded, in bytes.
+const DefaultMaxSize = 50 << 20
+
+// DefaultTimeout bounds the whole download, from connecting to reading the last byte.
+const DefaultTimeout = 10 * time.Second
+
+// DefaultMaxRedirects is how many redirects are followed.
+const DefaultMaxRedirects = 3
+
+type ErrorCode string
+
+const ERROR_URL_NOT_ALLOWED ErrorCode = "url_not_allowed"
+const ERROR_FETCH_FAILED ErrorCode = "fetch_failed"
+const ERROR_TIMEOUT ErrorCode = "fetch_timeout"
+const ERROR_TOO_LARGE ErrorCode = "too_large"
+const ERROR_NOT_AN_IMAGE ErrorCode = "not_an_image"
+
+// FetchError is a download which was refused or failed.
+type FetchError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e FetchError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+type Config struct {
+	// MaxSize is the largest image downloaded, in bytes, defaulting to DefaultMaxSize.
+	MaxSize int64
+	// Timeout bounds the whole download, defaulting to DefaultTimeout.
+	Timeout time.Duration
+	// MaxRedirects is how many redirects are followed.  Zero refuses redirects.
+	MaxRedirects int
+	// AllowPrivate allows downloads from loopback, private and link local addresses, which are refused by default
+	// so that the server can't be used to reach internal services.
+	AllowPrivate bool
+}
+
+// Fetcher downloads images from URLs given by clients, refusing anything but http and https, addresses on internal
+// networks, and responses which are too large, too slow or not images.
+type Fetcher struct {
+	MaxSize int64
+	client  *http.Client
+}
+
+func BuildFetcher(config Config) *Fetcher {
+	maxSize := config.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	if !config.AllowPrivate {
+		// checked once the host has been resolved, so that a public name resolving to an internal address is refused
+		dialer.Control = refusePrivate
+	}
+	transport := &http.Transport{
+		// a proxy would make the connection on the server's behalf, bypassing the address check
+		Proxy:                 nil,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	maxRedirects := config.MaxRedirects
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return FetchError{Code: ERROR_FETCH_FAILED, Message: fmt.Sprintf("more than %d redirects", maxRedirects)}
+			}
+			return checkScheme(req.URL)
+		},
+	}
+	return &Fetcher{MaxSize: maxSize, client: client}
+}
+
+// Fetch downloads the image at the URL.  The body returns a FetchError if it's larger than MaxSize or too slow.
+func (f *Fetcher) Fetch(ctx context.Context, rawUrl string) (io.ReadCloser, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Host == "" {
+		return nil, FetchError{Code: ERROR_URL_NOT_ALLOWED, Message: "not an absolute URL"}
+	}
+	if err := checkScheme(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, FetchError{Code: ERROR_URL_NOT_ALLOWED, Message: err.Error()}
+	}
+	req.Header.Set("Accept", "image/*")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, describeFailure(err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, FetchError{Code: ERROR_FETCH_FAILED, Message: fmt.Sprintf("server responded %s", resp.Status)}
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mediaType, "image/") {
+		resp.Body.Close()
+		return nil, FetchError{Code: ERROR_NOT_AN_IMAGE, Message: fmt.Sprintf("content type is %q", resp.Header.Get("Content-Type"))}
+	}
+	if resp.ContentLength > f.MaxSize {
+		resp.Body.Close()
+		return nil, FetchError{Code: ERROR_TOO_LARGE, Message: fmt.Sprintf("image is %d bytes, the limit is %d", resp.ContentLength, f.MaxSize)}
+	}
+	return &limitedBody{body: resp.Body, remaining: f.MaxSize, maxSize: f.MaxSize}, nil
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return FetchError{Code: ERROR_URL_NOT_ALLOWED, Message: fmt.Sprintf("scheme %q isn't allowed", u.Scheme)}
+	}
+	return nil
+}
+
+// specialPurpose are the IANA special-purpose address blocks, from
+// https://www.iana.org/assignments/iana-ipv4-special-registry and iana-ipv6-special-registry, none of which images
+// are fetched from.  Multicast is refused separately.
+var specialPurpose = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.31.196.0/24"),
+	netip.MustParsePrefix("192.52.193.0/24"),
+	netip.MustParsePrefix("192.88.99.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("192.175.48.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// IPv4-compatible addresses are deprecated, and include the unspecified and loopback addresses
+	netip.MustParsePrefix("::/96"),
+	netip.MustParsePrefix("::ffff:0:0/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("100:0:0:1::/64"),
+	netip.MustParsePrefix("2001::/23"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("2620:4f:8000::/48"),
+	netip.MustParsePrefix("3fff::/20"),
+	netip.MustParsePrefix("5f00::/16"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	// site local addresses are deprecated, but may still be routed internally
+	netip.MustParsePrefix("fec0::/10"),
+}
+
+// nat64 is the well-known NAT64 prefix, whose addresses embed an IPv4 address in their last 32 bits.
+var nat64 = netip.MustParsePrefix("64:ff9b::/96")
+
+// sixToFour is the 6to4 prefix, whose addresses embed an IPv4 address in the 32 bits after it.
+var sixToFour = netip.MustParsePrefix("2002::/16")
+
+// embeddedIPv4 returns the IPv4 address a NAT64 or 6to4 address leads to.
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	octets := addr.As16()
+	switch {
+	case nat64.Contains(addr):
+		return netip.AddrFrom4([4]byte(octets[12:16])), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(octets[2:6])), true
+	default:
+		return netip.Addr{}, false
+	}
+}
+
+// isInternal is whether the address is on an internal network, or leads to one.
+func isInternal(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if embedded, ok := embeddedIPv4(addr); ok {
+		addr = embedded
+	}
+	if addr.IsLoopback() || addr.IsPrivate() || addr.IsLinkLocalUnicast() || addr.IsLinkLocalMulticast() ||
+		addr.IsInterfaceLocalMulticast() || addr.IsMulticast() || addr.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range specialPurpose {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// refusePrivate is a dialer control which refuses connections to addresses on internal networks.
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return FetchError{Code: ERROR_URL_NOT_ALLOWED, Message: err.Error()}
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return FetchError{Code: ERROR_URL_NOT_ALLOWED, Message: err.Error()}
+	}
+	if isInternal(addr) {
+		return FetchError{Code: ERROR_URL_NOT_ALLOWED, Message: fmt.Sprintf("address %s isn't allowed", addr.Unmap())}
+	}
+	return nil
+}
+
+// describeFailure turns the client's error into a FetchError.
+func describeFailure(err error) error {
+	var fetchErr FetchError
+	if errors.As(err, &fetchErr) {
+		return fetchErr
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return FetchError{Code: ERROR_TIMEOUT, Message: "download timed out"}
+	}
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+	return FetchError{Code: ERROR_FETCH_FAILED, Message: err.Error()}
+}
+
+// limitedBody is a response body which fails once more than maxSize bytes are read.
+type limitedBody struct {
+	body      io.ReadCloser
+	remaining int64
+	maxSize   int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, FetchError{Code: ERROR_TOO_LARGE, Message: fmt.Sprintf("image is larger than the limit of %d bytes", l.maxSize)}
+	}
+	// one byte over the limit is allowed through so that oversized images can be told apart
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.body.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, FetchError{Code: ERROR_TOO_LARGE, Message: fmt.Sprintf("image is larger than the limit of %d bytes", l.maxSize)}
+	}
+	if err != nil && err != io.EOF {
+		err = describeFailure(err)
+	}
+	return n, err
+}
+
+func (l *limitedBody) Close() error {
+	return l.body.Close()
+}
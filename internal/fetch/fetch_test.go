@@ -0,0 +1,160 @@
+package fetch
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var pngContent = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+func serveImage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(pngContent)
+}
+
+func TestFetcher_Fetch(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/image.png", serveImage)
+	mux.HandleFunc("/redirect", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/image.png", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/to-file", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file:///etc/passwd", http.StatusFound)
+	})
+	mux.HandleFunc("/missing", http.NotFound)
+	mux.HandleFunc("/page.html", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html></html>"))
+	})
+	mux.HandleFunc("/large.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(bytes.Repeat([]byte{0}, 100))
+	})
+	mux.HandleFunc("/streamed.png", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		// flushing before writing everything sends it chunked, without a content length
+		w.Write(bytes.Repeat([]byte{0}, 10))
+		w.(http.Flusher).Flush()
+		w.Write(bytes.Repeat([]byte{0}, 90))
+	})
+	mux.HandleFunc("/slow.png", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+		serveImage(w, r)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	allowed := Config{AllowPrivate: true, MaxSize: 64, Timeout: 200 * time.Millisecond, MaxRedirects: 2}
+	tests := map[string]struct {
+		config   Config
+		url      string
+		wantCode ErrorCode
+	}{
+		"image":              {config: allowed, url: server.URL + "/image.png"},
+		"redirect":           {config: allowed, url: server.URL + "/redirect"},
+		"loopback refused":   {config: Config{}, url: server.URL + "/image.png", wantCode: ERROR_URL_NOT_ALLOWED},
+		"file scheme":        {config: allowed, url: "file:///etc/passwd", wantCode: ERROR_URL_NOT_ALLOWED},
+		"relative":           {config: allowed, url: "/image.png", wantCode: ERROR_URL_NOT_ALLOWED},
+		"redirect loop":      {config: allowed, url: server.URL + "/loop", wantCode: ERROR_FETCH_FAILED},
+		"redirect to file":   {config: allowed, url: server.URL + "/to-file", wantCode: ERROR_URL_NOT_ALLOWED},
+		"redirect disabled":  {config: Config{AllowPrivate: true}, url: server.URL + "/redirect", wantCode: ERROR_FETCH_FAILED},
+		"not found":          {config: allowed, url: server.URL + "/missing", wantCode: ERROR_FETCH_FAILED},
+		"not an image":       {config: allowed, url: server.URL + "/page.html", wantCode: ERROR_NOT_AN_IMAGE},
+		"too large":          {config: allowed, url: server.URL + "/large.png", wantCode: ERROR_TOO_LARGE},
+		"streamed too large": {config: allowed, url: server.URL + "/streamed.png", wantCode: ERROR_TOO_LARGE},
+		"slow":               {config: allowed, url: server.URL + "/slow.png", wantCode: ERROR_TIMEOUT},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			f := BuildFetcher(test.config)
+
+			body, err := f.Fetch(context.Background(), test.url)
+			var content []byte
+			if err == nil {
+				content, err = io.ReadAll(body)
+				body.Close()
+			}
+
+			if test.wantCode == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(content, pngContent) {
+					t.Errorf("got %q, want %q", content, pngContent)
+				}
+				return
+			}
+			var fetchErr FetchError
+			if !errors.As(err, &fetchErr) {
+				t.Fatalf("got %v, want a FetchError", err)
+			}
+			if fetchErr.Code != test.wantCode {
+				t.Errorf("got %s, want %s", fetchErr, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestRefusePrivate(t *testing.T) {
+	tests := map[string]struct {
+		address     string
+		wantRefused bool
+	}{
+		"public":         {address: "93.184.216.34:80"},
+		"public ipv6":    {address: "[2606:2800:220:1::]:443"},
+		"loopback":       {address: "127.0.0.1:80", wantRefused: true},
+		"private":        {address: "10.1.2.3:80", wantRefused: true},
+		"private 192":    {address: "192.168.1.1:80", wantRefused: true},
+		"metadata":       {address: "169.254.169.254:80", wantRefused: true},
+		"unspecified":    {address: "0.0.0.0:80", wantRefused: true},
+		"cgnat":          {address: "100.64.1.1:80", wantRefused: true},
+		"ipv6 loopback":  {address: "[::1]:80", wantRefused: true},
+		"unique local":   {address: "[fd00::1]:80", wantRefused: true},
+		"mapped private": {address: "[::ffff:127.0.0.1]:80", wantRefused: true},
+		"this network":   {address: "0.1.2.3:80", wantRefused: true},
+		"ietf protocol":  {address: "192.0.0.8:80", wantRefused: true},
+		"documentation":  {address: "203.0.113.5:80", wantRefused: true},
+		"benchmarking":   {address: "198.19.1.1:80", wantRefused: true},
+		"reserved":       {address: "240.1.2.3:80", wantRefused: true},
+		"broadcast":      {address: "255.255.255.255:80", wantRefused: true},
+		"6to4 relay":     {address: "192.88.99.1:80", wantRefused: true},
+		"nat64 private":  {address: "[64:ff9b::10.0.0.1]:80", wantRefused: true},
+		"nat64 metadata": {address: "[64:ff9b::169.254.169.254]:80", wantRefused: true},
+		"nat64 public":   {address: "[64:ff9b::93.184.216.34]:80"},
+		"local nat64":    {address: "[64:ff9b:1::1]:80", wantRefused: true},
+		"6to4 loopback":  {address: "[2002:7f00:1::1]:80", wantRefused: true},
+		"6to4 private":   {address: "[2002:c0a8:101::1]:80", wantRefused: true},
+		"6to4 public":    {address: "[2002:5db8:d822::1]:80"},
+		"teredo":         {address: "[2001:0:4136:e378::1]:80", wantRefused: true},
+		"ipv6 docs":      {address: "[2001:db8::1]:80", wantRefused: true},
+		"ipv4 compat":    {address: "[::10.0.0.1]:80", wantRefused: true},
+		"site local":     {address: "[fec0::1]:80", wantRefused: true},
+		"discard only":   {address: "[100::1]:80", wantRefused: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := refusePrivate("tcp", test.address, nil)
+			if (err != nil) != test.wantRefused {
+				t.Errorf("got %v, wantRefused %v", err, test.wantRefused)
+			}
+			if err != nil && !strings.Contains(err.Error(), string(ERROR_URL_NOT_ALLOWED)) {
+				t.Errorf("got %v, want %s", err, ERROR_URL_NOT_ALLOWED)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// orientationTag is the EXIF tag holding the camera's orientation, 1 to 8.
+const orientationTag = 0x0112
+
+// readOrientation finds the EXIF orientation of a jpeg, png or webp, leaving the image rewound.  Images without one,
+// or with one that can't be read, are treated as upright.
+func readOrientation(imageFile io.ReadSeeker, format Format) (int, error) {
+	orientation := 1
+	switch format {
+	case FORMAT_JPEG:
+		orientation = readJpegOrientation(imageFile)
+	case FORMAT_PNG:
+		orientation = readPngOrientation(imageFile)
+	case FORMAT_WEBP:
+		orientation = readWebpOrientation(imageFile)
+	}
+	if _, err := imageFile.Seek(0, io.SeekStart); err != nil {
+		return 1, fmt.Errorf("failed to reset file pointer: %v", err)
+	}
+	return orientation, nil
+}
+
+// readPngOrientation finds the EXIF orientation in a png's eXIf chunk, skipping over the other chunks.
+func readPngOrientation(r io.ReadSeeker) int {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:]) != "\x89PNG\r\n\x1a\n" {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 1
+		}
+		length := int64(binary.BigEndian.Uint32(header[:]))
+		switch string(header[4:]) {
+		case "eXIf":
+			orientation, err := readExifOrientation(r, length)
+			if err != nil {
+				return 1
+			}
+			return orientation
+		case "IEND":
+			return 1
+		}
+		// data and crc
+		if _, err := r.Seek(length+4, io.SeekCurrent); err != nil {
+			return 1
+		}
+	}
+}
+
+// readWebpOrientation finds the EXIF orientation in a webp's EXIF chunk, skipping over the other chunks.
+func readWebpOrientation(r io.ReadSeeker) int {
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(r, header[:8]); err != nil {
+			return 1
+		}
+		size := int64(binary.LittleEndian.Uint32(header[4:]))
+		if string(header[:4]) == "EXIF" {
+			orientation, err := readExifOrientation(r, size)
+			if err != nil {
+				return 1
+			}
+			return orientation
+		}
+		// chunks are padded to an even size
+		if _, err := r.Seek(size+size%2, io.SeekCurrent); err != nil {
+			return 1
+		}
+	}
+}
+
+// readJpegOrientation finds the EXIF orientation in a jpeg's APP1 segment.  Images without one, or with one that
+// can't be read, are treated as upright.
+func readJpegOrientation(r io.Reader) int {
+	br := bufio.NewReader(r)
+	var marker [2]byte
+	if _, err := io.ReadFull(br, marker[:]); err != nil || marker != [2]byte{0xFF, 0xD8} {
+		return 1
+	}
+	for {
+		if _, err := io.ReadFull(br, marker[:]); err != nil || marker[0] != 0xFF {
+			return 1
+		}
+		// start of scan, no more metadata segments follow
+		if marker[1] == 0xDA || marker[1] == 0xD9 {
+			return 1
+		}
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil || length < 2 {
+			return 1
+		}
+		segment := make([]byte, length-2)
+		if _, err := io.ReadFull(br, segment); err != nil {
+			return 1
+		}
+		if marker[1] == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+	}
+}
+
+// exifOrientation reads the orientation from IFD0 of a tiff structured EXIF block.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for entry := offset + 2; entry+12 <= len(tiff) && count > 0; entry, count = entry+12, count-1 {
+		if order.Uint16(tiff[entry:]) != orientationTag {
+			continue
+		}
+		orientation := int(order.Uint16(tiff[entry+8:]))
+		if orientation < 1 || orientation > 8 {
+			return 1
+		}
+		return orientation
+	}
+	return 1
+}
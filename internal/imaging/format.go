@@ -0,0 +1,99 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+type Format string
+
+const FORMAT_PNG Format = "png"
+const FORMAT_JPEG Format = "jpeg"
+const FORMAT_GIF Format = "gif"
+const FORMAT_WEBP Format = "webp"
+const FORMAT_BMP Format = "bmp"
+const FORMAT_TIFF Format = "tiff"
+
+// DefaultNativeFormats are the formats interrogate_forever is known to read.  Anything else is transcoded to png.
+var DefaultNativeFormats = []Format{FORMAT_PNG, FORMAT_JPEG}
+
+// Extension is the file extension for images in the format.
+func (f Format) Extension() string {
+	if f == FORMAT_JPEG {
+		return "jpg"
+	}
+	return string(f)
+}
+
+type UnsupportedFormatError struct {
+	MimeType string
+}
+
+func (e UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("unsupported file type: %s", e.MimeType)
+}
+
+// InvalidImageError is an image which claims to be in a supported format but can't be read.
+type InvalidImageError struct {
+	Reason string
+}
+
+func (e InvalidImageError) Error() string {
+	return fmt.Sprintf("invalid image: %s", e.Reason)
+}
+
+// DetectFormat sniffs the image's format from its first bytes, leaving it rewound for reading.
+func DetectFormat(imageFile io.ReadSeeker) (Format, error) {
+	buffer := make([]byte, 512)
+	n, err := io.ReadFull(imageFile, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+	buffer = buffer[:n]
+
+	// reset file pointer to beginning
+	if _, err := imageFile.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to reset file pointer: %v", err)
+	}
+
+	// http.DetectContentType doesn't know tiff
+	if bytes.HasPrefix(buffer, []byte("II*\x00")) || bytes.HasPrefix(buffer, []byte("MM\x00*")) {
+		return FORMAT_TIFF, nil
+	}
+	mimeType := http.DetectContentType(buffer)
+	switch mimeType {
+	case "image/png":
+		return FORMAT_PNG, nil
+	case "image/jpeg":
+		return FORMAT_JPEG, nil
+	case "image/gif":
+		return FORMAT_GIF, nil
+	case "image/webp":
+		return FORMAT_WEBP, nil
+	case "image/bmp":
+		return FORMAT_BMP, nil
+	default:
+		return "", UnsupportedFormatError{MimeType: mimeType}
+	}
+}
+
+// ParseFormat parses a format name such as png or jpeg.
+func ParseFormat(name string) (Format, error) {
+	switch format := Format(name); format {
+	case FORMAT_PNG, FORMAT_JPEG, FORMAT_GIF, FORMAT_WEBP, FORMAT_BMP, FORMAT_TIFF:
+		return format, nil
+	case "jpg":
+		return FORMAT_JPEG, nil
+	default:
+		return "", fmt.Errorf("unknown image format: %s", name)
+	}
+}
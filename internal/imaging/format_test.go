@@ -0,0 +1,90 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// webp1x1 is a 1x1 lossless webp, since x/image can't encode webp.
+const webp1x1 = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 3))
+	img.Set(1, 1, color.NRGBA{R: 255, A: 255})
+	return img
+}
+
+func encodeTestImage(t *testing.T, format Format) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case FORMAT_PNG:
+		err = png.Encode(&buf, testImage())
+	case FORMAT_JPEG:
+		err = jpeg.Encode(&buf, testImage(), nil)
+	case FORMAT_GIF:
+		err = gif.Encode(&buf, testImage(), nil)
+	case FORMAT_BMP:
+		err = bmp.Encode(&buf, testImage())
+	case FORMAT_TIFF:
+		err = tiff.Encode(&buf, testImage(), nil)
+	case FORMAT_WEBP:
+		var content []byte
+		content, err = base64.StdEncoding.DecodeString(webp1x1)
+		buf.Write(content)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDetectFormat(t *testing.T) {
+	tests := map[string]struct {
+		content         func(t *testing.T) []byte
+		want            Format
+		wantUnsupported bool
+	}{
+		"png":  {content: func(t *testing.T) []byte { return encodeTestImage(t, FORMAT_PNG) }, want: FORMAT_PNG},
+		"jpeg": {content: func(t *testing.T) []byte { return encodeTestImage(t, FORMAT_JPEG) }, want: FORMAT_JPEG},
+		"gif":  {content: func(t *testing.T) []byte { return encodeTestImage(t, FORMAT_GIF) }, want: FORMAT_GIF},
+		"webp": {content: func(t *testing.T) []byte { return encodeTestImage(t, FORMAT_WEBP) }, want: FORMAT_WEBP},
+		"bmp":  {content: func(t *testing.T) []byte { return encodeTestImage(t, FORMAT_BMP) }, want: FORMAT_BMP},
+		"tiff": {content: func(t *testing.T) []byte { return encodeTestImage(t, FORMAT_TIFF) }, want: FORMAT_TIFF},
+		"text": {content: func(t *testing.T) []byte { return []byte("plain text") }, wantUnsupported: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			content := test.content(t)
+			r := bytes.NewReader(content)
+
+			got, err := DetectFormat(r)
+
+			var unsupported UnsupportedFormatError
+			if errors.As(err, &unsupported) != test.wantUnsupported {
+				t.Fatalf("got error %v, wantUnsupported %v", err, test.wantUnsupported)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+			// must be rewound
+			rest, _ := io.ReadAll(r)
+			if !bytes.Equal(rest, content) {
+				t.Error("reader was not rewound")
+			}
+		})
+	}
+}
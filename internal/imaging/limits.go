@@ -0,0 +1,79 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"io"
+)
+
+// DefaultMaxFileSize is the largest image file accepted, in bytes.
+const DefaultMaxFileSize = 50 << 20
+
+// DefaultMaxPixels is the most pixels an image may have.  A 50MP phone photo fits with room to spare.
+const DefaultMaxPixels = 100_000_000
+
+// DefaultMaxDimension is the longest either edge of an image may be.
+const DefaultMaxDimension = 20000
+
+// Limits bound the images which are accepted, so that a small file can't decompress into an enormous image.  Zero
+// fields are unlimited.
+type Limits struct {
+	MaxFileSize  int
+	MaxPixels    int
+	MaxDimension int
+	// FullDecode decodes the whole image, rejecting truncated or corrupt images which have a valid header.
+	FullDecode bool
+}
+
+// ImageTooLargeError is an image which exceeds the configured limits.
+type ImageTooLargeError struct {
+	Reason string
+}
+
+func (e ImageTooLargeError) Error() string {
+	return fmt.Sprintf("image too large: %s", e.Reason)
+}
+
+// Validate checks the image against the limits from its header, before any of its pixels are decoded, leaving it
+// rewound for reading.  Images which can't be read return an InvalidImageError, and images which exceed the limits
+// an ImageTooLargeError.
+func Validate(imageFile io.ReadSeeker, limits Limits) (image.Config, error) {
+	size, err := imageFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("could not measure file: %s", err)
+	}
+	if _, err := imageFile.Seek(0, io.SeekStart); err != nil {
+		return image.Config{}, fmt.Errorf("failed to reset file pointer: %v", err)
+	}
+	if limits.MaxFileSize > 0 && size > int64(limits.MaxFileSize) {
+		return image.Config{}, ImageTooLargeError{Reason: fmt.Sprintf("file is %d bytes, the limit is %d", size, limits.MaxFileSize)}
+	}
+
+	config, _, err := image.DecodeConfig(imageFile)
+	if err != nil {
+		return image.Config{}, InvalidImageError{Reason: err.Error()}
+	}
+	if _, err := imageFile.Seek(0, io.SeekStart); err != nil {
+		return image.Config{}, fmt.Errorf("failed to reset file pointer: %v", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return image.Config{}, InvalidImageError{Reason: fmt.Sprintf("image is %dx%d", config.Width, config.Height)}
+	}
+	if limits.MaxDimension > 0 && max(config.Width, config.Height) > limits.MaxDimension {
+		return image.Config{}, ImageTooLargeError{Reason: fmt.Sprintf("image is %dx%d, the limit is %d on either edge", config.Width, config.Height, limits.MaxDimension)}
+	}
+	// checked by division so that enormous dimensions can't overflow
+	if limits.MaxPixels > 0 && config.Width > limits.MaxPixels/config.Height {
+		return image.Config{}, ImageTooLargeError{Reason: fmt.Sprintf("image is %dx%d, the limit is %d pixels", config.Width, config.Height, limits.MaxPixels)}
+	}
+
+	if limits.FullDecode {
+		if _, _, err := image.Decode(imageFile); err != nil {
+			return image.Config{}, InvalidImageError{Reason: err.Error()}
+		}
+		if _, err := imageFile.Seek(0, io.SeekStart); err != nil {
+			return image.Config{}, fmt.Errorf("failed to reset file pointer: %v", err)
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,94 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"testing"
+)
+
+// pngWithSize is a png header claiming the dimensions, with no pixel data.
+func pngWithSize(width, height uint32) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, width)
+	ihdr = binary.BigEndian.AppendUint32(ihdr, height)
+	ihdr = append(ihdr, 8, 0, 0, 0, 0)
+	out := []byte("\x89PNG\r\n\x1a\n")
+	out = binary.BigEndian.AppendUint32(out, uint32(len(ihdr)-4))
+	out = append(out, ihdr...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestValidate(t *testing.T) {
+	valid := encodePng(t, image.NewGray(image.Rect(0, 0, 40, 20)))
+
+	tests := map[string]struct {
+		content      []byte
+		limits       Limits
+		wantTooLarge bool
+		wantInvalid  bool
+	}{
+		"valid": {
+			content: valid,
+			limits:  Limits{MaxFileSize: 1 << 20, MaxPixels: 800, MaxDimension: 40, FullDecode: true},
+		},
+		"unlimited": {
+			content: pngWithSize(60000, 60000),
+		},
+		"file too large": {
+			content:      valid,
+			limits:       Limits{MaxFileSize: 10},
+			wantTooLarge: true,
+		},
+		"too many pixels": {
+			content:      pngWithSize(60000, 60000),
+			limits:       Limits{MaxPixels: DefaultMaxPixels},
+			wantTooLarge: true,
+		},
+		"too wide": {
+			content:      pngWithSize(30000, 10),
+			limits:       Limits{MaxDimension: DefaultMaxDimension},
+			wantTooLarge: true,
+		},
+		"header only": {
+			content: pngWithSize(10, 10),
+			limits:  Limits{MaxPixels: DefaultMaxPixels},
+		},
+		"header only full decode": {
+			content:     pngWithSize(10, 10),
+			limits:      Limits{FullDecode: true},
+			wantInvalid: true,
+		},
+		"truncated full decode": {
+			content:     valid[:len(valid)-20],
+			limits:      Limits{FullDecode: true},
+			wantInvalid: true,
+		},
+		"garbage": {
+			content:     []byte("\x89PNG\r\n\x1a\nnot really"),
+			wantInvalid: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := bytes.NewReader(test.content)
+
+			_, err := Validate(r, test.limits)
+
+			var tooLarge ImageTooLargeError
+			var invalid InvalidImageError
+			if errors.As(err, &tooLarge) != test.wantTooLarge {
+				t.Errorf("got error %v, wantTooLarge %v", err, test.wantTooLarge)
+			}
+			if errors.As(err, &invalid) != test.wantInvalid {
+				t.Errorf("got error %v, wantInvalid %v", err, test.wantInvalid)
+			}
+			if err == nil && r.Len() != len(test.content) {
+				t.Error("reader was not rewound")
+			}
+		})
+	}
+}
@@ -0,0 +1,311 @@
+package imaging
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// maxExifRead is how much of a png or webp EXIF chunk is read to find the orientation, which is in the first IFD.
+const maxExifRead = 64 << 10
+
+// CanStripMetadata is whether StripMetadata understands the format.  Other formats need transcoding to drop their
+// metadata.
+func CanStripMetadata(format Format) bool {
+	switch format {
+	case FORMAT_JPEG, FORMAT_PNG, FORMAT_WEBP:
+		return true
+	default:
+		return false
+	}
+}
+
+// StripMetadata copies the image to dst without its EXIF, XMP, IPTC, comments and text, and without re-encoding it.
+// Colour profiles are kept, since the image looks different without them, and so is the EXIF orientation, in an EXIF
+// block holding nothing else, since the image is displayed the wrong way round without it.  The image is streamed a
+// segment at a time rather than read into memory.
+func StripMetadata(dst io.Writer, src io.ReadSeeker, format Format) error {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to reset file pointer: %v", err)
+	}
+	switch format {
+	case FORMAT_JPEG:
+		return stripJpeg(dst, bufio.NewReader(src))
+	case FORMAT_PNG:
+		return stripPng(dst, bufio.NewReader(src))
+	case FORMAT_WEBP:
+		return stripWebp(dst, src)
+	default:
+		return fmt.Errorf("can't strip metadata from %s", format)
+	}
+}
+
+// truncated reports a read which ran out of image as an InvalidImageError, and passes any other error on.
+func truncated(err error, reason string) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return InvalidImageError{Reason: reason}
+	}
+	return err
+}
+
+// orientationExif builds a big endian tiff structured EXIF block holding only the orientation.
+func orientationExif(orientation int) []byte {
+	tiff := []byte("MM\x00*\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientationTag)
+	// a single SHORT, padded to the four byte value field
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, uint16(orientation))
+	tiff = append(tiff, 0, 0)
+	// no next IFD
+	return append(tiff, 0, 0, 0, 0)
+}
+
+// readExifOrientation reads the orientation from the start of an EXIF chunk of size bytes, and discards the rest.
+func readExifOrientation(r io.Reader, size int64) (int, error) {
+	exif := make([]byte, min(size, maxExifRead))
+	if _, err := io.ReadFull(r, exif); err != nil {
+		return 1, err
+	}
+	if _, err := io.CopyN(io.Discard, r, size-int64(len(exif))); err != nil {
+		return 1, err
+	}
+	return exifOrientation(exif), nil
+}
+
+// stripJpeg drops every application segment except JFIF, ICC profiles and Adobe's colour transform, and comments.  The
+// first EXIF segment is replaced by one holding only its orientation.
+func stripJpeg(dst io.Writer, src *bufio.Reader) error {
+	var header [4]byte
+	if _, err := io.ReadFull(src, header[:2]); err != nil || header[0] != 0xFF || header[1] != 0xD8 {
+		return InvalidImageError{Reason: "missing jpeg start of image"}
+	}
+	if _, err := dst.Write(header[:2]); err != nil {
+		return err
+	}
+	exifSeen := false
+	for {
+		if _, err := io.ReadFull(src, header[:2]); err != nil || header[0] != 0xFF {
+			return InvalidImageError{Reason: "truncated jpeg segment"}
+		}
+		marker := header[1]
+		// start of scan, the entropy coded image data follows without any more metadata
+		if marker == 0xDA {
+			if _, err := dst.Write(header[:2]); err != nil {
+				return err
+			}
+			_, err := io.Copy(dst, src)
+			return err
+		}
+		if _, err := io.ReadFull(src, header[2:]); err != nil {
+			return InvalidImageError{Reason: "truncated jpeg segment"}
+		}
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return InvalidImageError{Reason: "truncated jpeg segment"}
+		}
+		// segments are at most 64KiB
+		payload := make([]byte, length-2)
+		if _, err := io.ReadFull(src, payload); err != nil {
+			return InvalidImageError{Reason: "truncated jpeg segment"}
+		}
+		if marker == 0xE1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) && !exifSeen {
+			exifSeen = true
+			if orientation := exifOrientation(payload[6:]); orientation != 1 {
+				segment := append([]byte("Exif\x00\x00"), orientationExif(orientation)...)
+				out := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(segment)+2))
+				if _, err := dst.Write(append(out, segment...)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if keepJpegSegment(marker, payload) {
+			if _, err := dst.Write(header[:]); err != nil {
+				return err
+			}
+			if _, err := dst.Write(payload); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func keepJpegSegment(marker byte, payload []byte) bool {
+	switch {
+	case marker == 0xFE: // comment
+		return false
+	case marker == 0xE0:
+		return bytes.HasPrefix(payload, []byte("JFIF\x00"))
+	case marker == 0xE2:
+		return bytes.HasPrefix(payload, []byte("ICC_PROFILE\x00"))
+	case marker == 0xEE:
+		return bytes.HasPrefix(payload, []byte("Adobe"))
+	case marker >= 0xE1 && marker <= 0xEF: // EXIF and XMP in APP1, IPTC in APP13
+		return false
+	default:
+		return true
+	}
+}
+
+// pngMetadataChunks are dropped from pngs.
+var pngMetadataChunks = map[string]bool{"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true}
+
+// stripPng drops the pngMetadataChunks.  An eXIf chunk is replaced by one holding only its orientation.
+func stripPng(dst io.Writer, src *bufio.Reader) error {
+	const signature = "\x89PNG\r\n\x1a\n"
+	var header [8]byte
+	if _, err := io.ReadFull(src, header[:]); err != nil || string(header[:]) != signature {
+		return InvalidImageError{Reason: "missing png signature"}
+	}
+	if _, err := dst.Write(header[:]); err != nil {
+		return err
+	}
+	for {
+		if _, err := io.ReadFull(src, header[:]); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return InvalidImageError{Reason: "truncated png chunk"}
+		}
+		length := int64(binary.BigEndian.Uint32(header[:]))
+		chunkType := string(header[4:])
+		switch {
+		case chunkType == "eXIf":
+			orientation, err := readExifOrientation(src, length)
+			if err != nil {
+				return truncated(err, "truncated png chunk")
+			}
+			if _, err := io.CopyN(io.Discard, src, 4); err != nil {
+				return truncated(err, "truncated png chunk")
+			}
+			if orientation != 1 {
+				data := append([]byte("eXIf"), orientationExif(orientation)...)
+				chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)-4))
+				chunk = append(chunk, data...)
+				chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(data))
+				if _, err := dst.Write(chunk); err != nil {
+					return err
+				}
+			}
+		case pngMetadataChunks[chunkType]:
+			// data and crc
+			if _, err := io.CopyN(io.Discard, src, length+4); err != nil {
+				return truncated(err, "truncated png chunk")
+			}
+		default:
+			if _, err := dst.Write(header[:]); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(dst, src, length+4); err != nil {
+				return truncated(err, "truncated png chunk")
+			}
+		}
+	}
+}
+
+// webp extended format flags for the chunks which are dropped
+const webpFlagExif = 0x08
+const webpFlagXmp = 0x04
+
+// webpChunkHeader is a riff chunk's fourcc and size, and where its data starts.
+type webpChunkHeader struct {
+	fourcc string
+	size   int64
+	offset int64
+}
+
+// paddedSize is the size of the chunk's data, which is padded to an even size.
+func (c webpChunkHeader) paddedSize() int64 {
+	return c.size + c.size%2
+}
+
+// stripWebp drops the EXIF and XMP chunks, clearing their flags.  The EXIF chunk is replaced by one holding only its
+// orientation.  The riff header holds the size of what follows, so the chunks are scanned before they're copied.
+func stripWebp(dst io.Writer, src io.ReadSeeker) error {
+	var header [12]byte
+	if _, err := io.ReadFull(src, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return InvalidImageError{Reason: "missing webp header"}
+	}
+	fileSize, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	var chunks []webpChunkHeader
+	orientation := 1
+	size := int64(4)
+	for pos := int64(12); pos < fileSize; pos += 8 + chunks[len(chunks)-1].paddedSize() {
+		if _, err := src.Seek(pos, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(src, header[:8]); err != nil {
+			return InvalidImageError{Reason: "truncated webp chunk"}
+		}
+		chunk := webpChunkHeader{fourcc: string(header[:4]), size: int64(binary.LittleEndian.Uint32(header[4:])), offset: pos + 8}
+		if chunk.offset+chunk.paddedSize() > fileSize {
+			return InvalidImageError{Reason: "truncated webp chunk"}
+		}
+		switch chunk.fourcc {
+		case "EXIF":
+			if orientation, err = readExifOrientation(src, chunk.size); err != nil {
+				return truncated(err, "truncated webp chunk")
+			}
+			if orientation != 1 {
+				size += 8 + int64(len(orientationExif(orientation)))
+			}
+		case "XMP ":
+		default:
+			size += 8 + chunk.paddedSize()
+		}
+		chunks = append(chunks, chunk)
+	}
+
+	out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(size))
+	if _, err := dst.Write(append(out, "WEBP"...)); err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		var data []byte
+		switch chunk.fourcc {
+		case "EXIF":
+			if orientation != 1 {
+				data = orientationExif(orientation)
+			}
+		case "XMP ":
+		default:
+			if _, err := src.Seek(chunk.offset, io.SeekStart); err != nil {
+				return err
+			}
+			out := binary.LittleEndian.AppendUint32([]byte(chunk.fourcc), uint32(chunk.size))
+			if chunk.fourcc == "VP8X" && chunk.size > 0 {
+				// the flags are the first byte of the data
+				var flags [1]byte
+				if _, err := io.ReadFull(src, flags[:]); err != nil {
+					return truncated(err, "truncated webp chunk")
+				}
+				flags[0] &^= webpFlagXmp
+				if orientation == 1 {
+					flags[0] &^= webpFlagExif
+				}
+				out = append(out, flags[0])
+			}
+			if _, err := dst.Write(out); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(dst, src, chunk.paddedSize()-int64(len(out)-8)); err != nil {
+				return truncated(err, "truncated webp chunk")
+			}
+		}
+		if data != nil {
+			out := binary.LittleEndian.AppendUint32([]byte(chunk.fourcc), uint32(len(data)))
+			if _, err := dst.Write(append(out, data...)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"testing"
+)
+
+// withPngText inserts a tEXt chunk after the png's IHDR chunk.
+func withPngText(content []byte, keyword, text string) []byte {
+	data := append([]byte("tEXt"+keyword+"\x00"), text...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)-4))
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(data))
+	// signature then the 25 byte IHDR chunk
+	ihdrEnd := 8 + 25
+	return append(append(bytes.Clone(content[:ihdrEnd]), chunk...), content[ihdrEnd:]...)
+}
+
+// withJpegComment inserts a comment segment after the jpeg's start of image marker.
+func withJpegComment(content []byte, comment string) []byte {
+	out := []byte{0xFF, 0xD8, 0xFF, 0xFE}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(comment)+2))
+	out = append(out, comment...)
+	return append(out, content[2:]...)
+}
+
+// webpChunk builds a riff chunk, padded to an even size.
+func webpChunk(fourcc string, data []byte) []byte {
+	out := binary.LittleEndian.AppendUint32([]byte(fourcc), uint32(len(data)))
+	out = append(out, data...)
+	if len(data)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// stripMetadata strips the image's metadata into memory.
+func stripMetadata(content []byte, format Format) ([]byte, error) {
+	var out bytes.Buffer
+	err := StripMetadata(&out, bytes.NewReader(content), format)
+	return out.Bytes(), err
+}
+
+// orientationWithSecret is an EXIF block holding the orientation, followed by other metadata.
+func orientationWithSecret(orientation int) []byte {
+	return append(orientationExif(orientation), "GPS secret"...)
+}
+
+// withPngExif inserts an eXIf chunk after the png's IHDR chunk.
+func withPngExif(content []byte, exif []byte) []byte {
+	data := append([]byte("eXIf"), exif...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(exif)))
+	chunk = append(chunk, data...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(data))
+	ihdrEnd := 8 + 25
+	return append(append(bytes.Clone(content[:ihdrEnd]), chunk...), content[ihdrEnd:]...)
+}
+
+// withJpegExif inserts an EXIF segment after the jpeg's start of image marker.
+func withJpegExif(content []byte, exif []byte) []byte {
+	segment := append([]byte("Exif\x00\x00"), exif...)
+	out := binary.BigEndian.AppendUint16([]byte{0xFF, 0xD8, 0xFF, 0xE1}, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, content[2:]...)
+}
+
+// extendedWebp wraps the simple webp in the extended format with an EXIF and XMP chunk.
+func extendedWebp(t *testing.T) []byte {
+	return extendedWebpWithExif(t, []byte("MM\x00*GPS secret"))
+}
+
+// extendedWebpWithExif wraps the simple webp in the extended format with the EXIF and an XMP chunk.
+func extendedWebpWithExif(t *testing.T, exif []byte) []byte {
+	simple := encodeTestImage(t, FORMAT_WEBP)
+	// flags, reserved, then the 1x1 canvas size less one
+	vp8x := []byte{webpFlagExif | webpFlagXmp, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	chunks := webpChunk("VP8X", vp8x)
+	chunks = append(chunks, simple[12:]...)
+	chunks = append(chunks, webpChunk("EXIF", exif)...)
+	chunks = append(chunks, webpChunk("XMP ", []byte("<x:xmpmeta>secret</x:xmpmeta>"))...)
+	out := binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(chunks)+4))
+	out = append(out, "WEBP"...)
+	return append(out, chunks...)
+}
+
+func TestStripMetadata(t *testing.T) {
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		content []byte
+		format  Format
+		secret  string
+	}{
+		"jpeg exif": {
+			content: withJpegExif(photo.Bytes(), orientationWithSecret(1)),
+			format:  FORMAT_JPEG,
+			secret:  "Exif",
+		},
+		"jpeg exif with orientation": {
+			content: withJpegExif(photo.Bytes(), orientationWithSecret(6)),
+			format:  FORMAT_JPEG,
+			secret:  "GPS secret",
+		},
+		"jpeg comment": {
+			content: withJpegComment(photo.Bytes(), "serial 12345"),
+			format:  FORMAT_JPEG,
+			secret:  "serial 12345",
+		},
+		"png text": {
+			content: withPngText(encodePng(t, testImage()), "Comment", "GPS secret"),
+			format:  FORMAT_PNG,
+			secret:  "GPS secret",
+		},
+		"png exif": {
+			content: withPngExif(encodePng(t, testImage()), orientationWithSecret(8)),
+			format:  FORMAT_PNG,
+			secret:  "GPS secret",
+		},
+		"webp exif and xmp": {
+			content: extendedWebp(t),
+			format:  FORMAT_WEBP,
+			secret:  "secret",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if !bytes.Contains(test.content, []byte(test.secret)) {
+				t.Fatal("test image is missing its metadata")
+			}
+
+			got, err := stripMetadata(test.content, test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(got, []byte(test.secret)) {
+				t.Error("metadata was not stripped")
+			}
+			if _, _, err := image.Decode(bytes.NewReader(got)); err != nil {
+				t.Errorf("stripped image can't be decoded: %v", err)
+			}
+		})
+	}
+}
+
+func TestStripMetadata_Unchanged(t *testing.T) {
+	content := encodePng(t, testImage())
+
+	got, err := stripMetadata(content, FORMAT_PNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Error("image without metadata was changed")
+	}
+}
+
+func TestStripMetadata_WebpFlags(t *testing.T) {
+	got, err := stripMetadata(extendedWebp(t), FORMAT_WEBP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flags := got[20]; flags&(webpFlagExif|webpFlagXmp) != 0 {
+		t.Errorf("got flags %08b, want the exif and xmp flags cleared", flags)
+	}
+	if size := binary.LittleEndian.Uint32(got[4:]); int(size) != len(got)-8 {
+		t.Errorf("got riff size %d, want %d", size, len(got)-8)
+	}
+}
+
+func TestStripMetadata_Truncated(t *testing.T) {
+	content := withPngText(encodePng(t, testImage()), "Comment", "text")
+
+	_, err := stripMetadata(content[:40], FORMAT_PNG)
+
+	var invalid InvalidImageError
+	if !errors.As(err, &invalid) {
+		t.Errorf("got %v, want InvalidImageError", err)
+	}
+}
+
+func TestStripMetadata_KeepsOrientation(t *testing.T) {
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := stripMetadata(withJpegExif(photo.Bytes(), orientationWithSecret(6)), FORMAT_JPEG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orientation := readJpegOrientation(bytes.NewReader(got)); orientation != 6 {
+		t.Errorf("got jpeg orientation %d, want 6", orientation)
+	}
+
+	got, err = stripMetadata(withPngExif(encodePng(t, testImage()), orientationWithSecret(8)), FORMAT_PNG)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exif := bytes.Index(got, []byte("eXIf")); exif < 0 || exifOrientation(got[exif+4:]) != 8 {
+		t.Error("png orientation was not kept")
+	}
+
+	got, err = stripMetadata(extendedWebpWithExif(t, orientationWithSecret(3)), FORMAT_WEBP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exif := bytes.Index(got, []byte("EXIF")); exif < 0 || exifOrientation(got[exif+8:]) != 3 {
+		t.Error("webp orientation was not kept")
+	}
+	if flags := got[20]; flags&webpFlagExif == 0 || flags&webpFlagXmp != 0 {
+		t.Errorf("got flags %08b, want only the exif flag set", flags)
+	}
+	if size := binary.LittleEndian.Uint32(got[4:]); int(size) != len(got)-8 {
+		t.Errorf("got riff size %d, want %d", size, len(got)-8)
+	}
+	if _, _, err := image.Decode(bytes.NewReader(got)); err != nil {
+		t.Errorf("stripped image can't be decoded: %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package imaging
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// DefaultMaxEdge is the longest edge images are downscaled to.  Taggers work at a much smaller, fixed resolution.
+const DefaultMaxEdge = 2048
+
+// jpegQuality is used when a downscaled or reoriented jpeg is re-encoded.
+const jpegQuality = 90
+
+// Preprocessing are the steps applied to an image before it's packaged.  The zero value changes nothing.
+type Preprocessing struct {
+	// AutoOrient rotates images upright according to their EXIF orientation, even when nothing else would re-encode
+	// them.  Images which are re-encoded are rotated upright regardless.
+	AutoOrient bool
+	// MaxEdge is the longest edge images are downscaled to.  Zero disables downscaling.
+	MaxEdge int
+	// Flatten draws images with transparency onto Background, which defaults to white.
+	Flatten    bool
+	Background color.Color
+}
+
+// Enabled is whether any step is enabled.
+func (p Preprocessing) Enabled() bool {
+	return p.AutoOrient || p.MaxEdge > 0 || p.Flatten
+}
+
+// ParsePreprocessing parses a comma separated list of steps: orient, downscale and flatten, or none.  maxEdge and
+// background configure the downscale and flatten steps.
+func ParsePreprocessing(steps string, maxEdge int, background color.Color) (Preprocessing, error) {
+	var p Preprocessing
+	for _, step := range strings.Split(steps, ",") {
+		switch strings.TrimSpace(step) {
+		case "orient":
+			p.AutoOrient = true
+		case "downscale":
+			p.MaxEdge = maxEdge
+		case "flatten":
+			p.Flatten = true
+			p.Background = background
+		case "none", "":
+		default:
+			return Preprocessing{}, fmt.Errorf("unknown preprocessing step: %s", step)
+		}
+	}
+	return p, nil
+}
+
+// ParseColor parses a hex colour such as #ffffff.
+func ParseColor(hex string) (color.Color, error) {
+	hex = strings.TrimPrefix(hex, "#")
+	if len(hex) != 6 {
+		return nil, fmt.Errorf("invalid colour: %s", hex)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid colour: %s", hex)
+	}
+	return color.RGBA{R: uint8(rgb >> 16), G: uint8(rgb >> 8), B: uint8(rgb), A: 0xFF}, nil
+}
+
+// Preprocess applies the preprocessing steps to the image, transcoding it to png when transcode is set.  Jpegs which
+// aren't transcoded stay jpegs.  Re-encoded images are always rotated upright by their EXIF orientation, which they'd
+// otherwise lose.  When nothing needs to change it returns nil, and the original image should be used.  Only the first
+// frame of an animated gif is kept.
+func Preprocess(imageFile io.ReadSeeker, format Format, steps Preprocessing, transcode bool) ([]byte, Format, error) {
+	if !transcode && !steps.Enabled() {
+		return nil, format, nil
+	}
+	// re-encoding drops the EXIF orientation, so it's read whenever the image may be re-encoded
+	orientation, err := readOrientation(imageFile, format)
+	if err != nil {
+		return nil, "", err
+	}
+	config, _, err := image.DecodeConfig(imageFile)
+	if err != nil {
+		return nil, "", InvalidImageError{Reason: err.Error()}
+	}
+	if _, err := imageFile.Seek(0, io.SeekStart); err != nil {
+		return nil, "", fmt.Errorf("failed to reset file pointer: %v", err)
+	}
+	resize := steps.MaxEdge > 0 && max(config.Width, config.Height) > steps.MaxEdge
+	flatten := steps.Flatten && mayHaveAlpha(config.ColorModel)
+	if !transcode && !(steps.AutoOrient && orientation != 1) && !resize && !flatten {
+		return nil, format, nil
+	}
+
+	img, _, err := image.Decode(imageFile)
+	if err != nil {
+		return nil, "", InvalidImageError{Reason: err.Error()}
+	}
+	changed := transcode
+	if resize {
+		img = downscale(img, steps.MaxEdge)
+		changed = true
+	}
+	if flatten && !isOpaque(img) {
+		img = flattenOnto(img, steps.Background)
+		changed = true
+	}
+	// the re-encoded image has no EXIF orientation, so it's rotated upright instead
+	if orientation != 1 && (changed || steps.AutoOrient) {
+		img = orient(toRGBA(img), orientation)
+		changed = true
+	}
+	if !changed {
+		return nil, format, nil
+	}
+
+	var out bytes.Buffer
+	if format == FORMAT_JPEG && !transcode {
+		if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+			return nil, "", fmt.Errorf("could not encode jpeg: %s", err)
+		}
+		return out.Bytes(), FORMAT_JPEG, nil
+	}
+	if err := png.Encode(&out, img); err != nil {
+		return nil, "", fmt.Errorf("could not encode png: %s", err)
+	}
+	return out.Bytes(), FORMAT_PNG, nil
+}
+
+// mayHaveAlpha is false for colour models which can't be transparent, so that they needn't be decoded to check.
+func mayHaveAlpha(model color.Model) bool {
+	switch model {
+	case color.YCbCrModel, color.GrayModel, color.Gray16Model, color.CMYKModel:
+		return false
+	default:
+		return true
+	}
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// downscale shrinks the image so that its longest edge is maxEdge, keeping its aspect ratio.
+func downscale(img image.Image, maxEdge int) *image.RGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width >= height {
+		width, height = maxEdge, max(1, height*maxEdge/width)
+	} else {
+		width, height = max(1, width*maxEdge/height), maxEdge
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	return dst
+}
+
+// orient applies an EXIF orientation, 2 to 8, so that the image is upright.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	width, height := src.Rect.Dx(), src.Rect.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			default:
+				dx, dy = x, y
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// flattenOnto draws the image over a solid background, removing its transparency.
+func flattenOnto(img image.Image, background color.Color) *image.RGBA {
+	if background == nil {
+		background = color.White
+	}
+	bounds := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), &image.Uniform{C: background}, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Over)
+	return dst
+}
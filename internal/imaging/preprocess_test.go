@@ -0,0 +1,353 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodePng(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// withOrientation inserts an EXIF segment holding the orientation after the jpeg's start of image marker.
+func withOrientation(jpegContent []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00*\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientationTag)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+
+	out := []byte{0xFF, 0xD8, 0xFF, 0xE1}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(segment)+2))
+	out = append(out, segment...)
+	return append(out, jpegContent[2:]...)
+}
+
+func TestPreprocess_Transcode(t *testing.T) {
+	for _, format := range []Format{FORMAT_GIF, FORMAT_WEBP, FORMAT_BMP, FORMAT_TIFF} {
+		t.Run(string(format), func(t *testing.T) {
+			transcoded, got, err := Preprocess(bytes.NewReader(encodeTestImage(t, format)), format, Preprocessing{}, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != FORMAT_PNG {
+				t.Errorf("got format %s, want png", got)
+			}
+			img, err := png.Decode(bytes.NewReader(transcoded))
+			if err != nil {
+				t.Fatalf("transcoded image is not a png: %v", err)
+			}
+			if img.Bounds().Empty() {
+				t.Error("transcoded image is empty")
+			}
+		})
+	}
+}
+
+func TestPreprocess_ReencodedOrients(t *testing.T) {
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewGray(image.Rect(0, 0, 400, 200)), nil); err != nil {
+		t.Fatal(err)
+	}
+	rotatedJpeg := withOrientation(photo.Bytes(), 6)
+	rotatedPng := withPngExif(encodePng(t, testImage()), orientationExif(6))
+
+	tests := map[string]struct {
+		content   []byte
+		format    Format
+		steps     Preprocessing
+		transcode bool
+		wantSize  image.Point
+	}{
+		"transcoded jpeg": {content: rotatedJpeg, format: FORMAT_JPEG, transcode: true, wantSize: image.Pt(200, 400)},
+		"downscaled jpeg": {content: rotatedJpeg, format: FORMAT_JPEG, steps: Preprocessing{MaxEdge: 100}, wantSize: image.Pt(50, 100)},
+		"downscaled png":  {content: rotatedPng, format: FORMAT_PNG, steps: Preprocessing{MaxEdge: 2}, wantSize: image.Pt(1, 2)},
+		"flattened png":   {content: rotatedPng, format: FORMAT_PNG, steps: Preprocessing{Flatten: true}, wantSize: image.Pt(3, 4)},
+		"oriented png":    {content: rotatedPng, format: FORMAT_PNG, steps: Preprocessing{AutoOrient: true}, wantSize: image.Pt(3, 4)},
+		"transcoded png":  {content: rotatedPng, format: FORMAT_PNG, transcode: true, wantSize: image.Pt(3, 4)},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			processed, _, err := Preprocess(bytes.NewReader(test.content), test.format, test.steps, test.transcode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if processed == nil {
+				t.Fatal("image was not re-encoded")
+			}
+			img, _, err := image.Decode(bytes.NewReader(processed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size := img.Bounds().Size(); size != test.wantSize {
+				t.Errorf("got size %v, want %v", size, test.wantSize)
+			}
+		})
+	}
+}
+
+func TestPreprocess_KeepsOrientationUnchanged(t *testing.T) {
+	// without AutoOrient an image which isn't otherwise re-encoded keeps its EXIF orientation for the reader
+	rotatedPng := withPngExif(encodePng(t, testImage()), orientationExif(6))
+
+	processed, _, err := Preprocess(bytes.NewReader(rotatedPng), FORMAT_PNG, Preprocessing{MaxEdge: 100}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed != nil {
+		t.Error("image was re-encoded")
+	}
+}
+
+func TestReadOrientation(t *testing.T) {
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		content []byte
+		format  Format
+		want    int
+	}{
+		"jpeg":        {content: withOrientation(photo.Bytes(), 6), format: FORMAT_JPEG, want: 6},
+		"png":         {content: withPngExif(encodePng(t, testImage()), orientationExif(8)), format: FORMAT_PNG, want: 8},
+		"webp":        {content: extendedWebpWithExif(t, orientationExif(3)), format: FORMAT_WEBP, want: 3},
+		"without":     {content: encodePng(t, testImage()), format: FORMAT_PNG, want: 1},
+		"unsupported": {content: encodeTestImage(t, FORMAT_GIF), format: FORMAT_GIF, want: 1},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := bytes.NewReader(test.content)
+			got, err := readOrientation(r, test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got orientation %d, want %d", got, test.want)
+			}
+			if r.Len() != len(test.content) {
+				t.Error("image was not rewound")
+			}
+		})
+	}
+}
+
+func TestPreprocess_Invalid(t *testing.T) {
+	truncated := encodeTestImage(t, FORMAT_BMP)[:20]
+
+	_, _, err := Preprocess(bytes.NewReader(truncated), FORMAT_BMP, Preprocessing{}, true)
+
+	var invalid InvalidImageError
+	if !errors.As(err, &invalid) {
+		t.Errorf("got %v, want InvalidImageError", err)
+	}
+}
+
+func TestPreprocess(t *testing.T) {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 4, 2))
+	var landscapeJpeg bytes.Buffer
+	if err := jpeg.Encode(&landscapeJpeg, image.NewGray(image.Rect(0, 0, 40, 20)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		content       []byte
+		format        Format
+		steps         Preprocessing
+		wantUnchanged bool
+		wantFormat    Format
+		wantSize      image.Point
+		wantOpaque    bool
+	}{
+		"no steps": {
+			content:       encodePng(t, testImage()),
+			format:        FORMAT_PNG,
+			wantUnchanged: true,
+		},
+		"small enough": {
+			content:       encodePng(t, testImage()),
+			format:        FORMAT_PNG,
+			steps:         Preprocessing{MaxEdge: 10},
+			wantUnchanged: true,
+		},
+		"downscale png": {
+			content:    encodePng(t, image.NewGray(image.Rect(0, 0, 20, 40))),
+			format:     FORMAT_PNG,
+			steps:      Preprocessing{MaxEdge: 10},
+			wantFormat: FORMAT_PNG,
+			wantSize:   image.Pt(5, 10),
+		},
+		"downscale jpeg stays jpeg": {
+			content:    landscapeJpeg.Bytes(),
+			format:     FORMAT_JPEG,
+			steps:      Preprocessing{MaxEdge: 10},
+			wantFormat: FORMAT_JPEG,
+			wantSize:   image.Pt(10, 5),
+		},
+		"upright jpeg": {
+			content:       withOrientation(landscapeJpeg.Bytes(), 1),
+			format:        FORMAT_JPEG,
+			steps:         Preprocessing{AutoOrient: true},
+			wantUnchanged: true,
+		},
+		"rotated jpeg": {
+			content:    withOrientation(landscapeJpeg.Bytes(), 6),
+			format:     FORMAT_JPEG,
+			steps:      Preprocessing{AutoOrient: true},
+			wantFormat: FORMAT_JPEG,
+			wantSize:   image.Pt(20, 40),
+		},
+		"rotated jpeg without auto orient": {
+			content:       withOrientation(landscapeJpeg.Bytes(), 6),
+			format:        FORMAT_JPEG,
+			wantUnchanged: true,
+		},
+		"flatten": {
+			content:    encodePng(t, transparent),
+			format:     FORMAT_PNG,
+			steps:      Preprocessing{Flatten: true},
+			wantFormat: FORMAT_PNG,
+			wantSize:   image.Pt(4, 2),
+			wantOpaque: true,
+		},
+		"flatten opaque": {
+			content:       encodePng(t, image.NewGray(image.Rect(0, 0, 4, 2))),
+			format:        FORMAT_PNG,
+			steps:         Preprocessing{Flatten: true},
+			wantUnchanged: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, format, err := Preprocess(bytes.NewReader(test.content), test.format, test.steps, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.wantUnchanged {
+				if got != nil {
+					t.Error("got a preprocessed image, want the original")
+				}
+				return
+			}
+			if format != test.wantFormat {
+				t.Errorf("got format %s, want %s", format, test.wantFormat)
+			}
+			img, _, err := image.Decode(bytes.NewReader(got))
+			if err != nil {
+				t.Fatalf("could not decode preprocessed image: %v", err)
+			}
+			if size := img.Bounds().Size(); size != test.wantSize {
+				t.Errorf("got size %v, want %v", size, test.wantSize)
+			}
+			if test.wantOpaque && !isOpaque(img) {
+				t.Error("got transparency, want an opaque image")
+			}
+		})
+	}
+}
+
+func TestPreprocess_FlattenBackground(t *testing.T) {
+	transparent := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	background := color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xFF}
+
+	got, _, err := Preprocess(bytes.NewReader(encodePng(t, transparent)), FORMAT_PNG, Preprocessing{Flatten: true, Background: background}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(got))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := color.RGBAModel.Convert(img.At(0, 0)); c != background {
+		t.Errorf("got %v, want %v", c, background)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// a 2x1 image, red then blue
+	red := color.RGBA{R: 0xFF, A: 0xFF}
+	blue := color.RGBA{B: 0xFF, A: 0xFF}
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	tests := map[string]struct {
+		orientation int
+		wantSize    image.Point
+		wantRed     image.Point
+	}{
+		"flipped":          {orientation: 2, wantSize: image.Pt(2, 1), wantRed: image.Pt(1, 0)},
+		"rotated 180":      {orientation: 3, wantSize: image.Pt(2, 1), wantRed: image.Pt(1, 0)},
+		"flipped vertical": {orientation: 4, wantSize: image.Pt(2, 1), wantRed: image.Pt(0, 0)},
+		"transposed":       {orientation: 5, wantSize: image.Pt(1, 2), wantRed: image.Pt(0, 0)},
+		"rotated 90":       {orientation: 6, wantSize: image.Pt(1, 2), wantRed: image.Pt(0, 0)},
+		"transversed":      {orientation: 7, wantSize: image.Pt(1, 2), wantRed: image.Pt(0, 1)},
+		"rotated 270":      {orientation: 8, wantSize: image.Pt(1, 2), wantRed: image.Pt(0, 1)},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := orient(src, test.orientation)
+
+			if size := got.Bounds().Size(); size != test.wantSize {
+				t.Fatalf("got size %v, want %v", size, test.wantSize)
+			}
+			if c := got.RGBAAt(test.wantRed.X, test.wantRed.Y); c != red {
+				t.Errorf("got %v at %v, want red", c, test.wantRed)
+			}
+		})
+	}
+}
+
+func TestParsePreprocessing(t *testing.T) {
+	tests := map[string]struct {
+		steps   string
+		want    Preprocessing
+		wantErr bool
+	}{
+		"all":     {steps: "orient,downscale,flatten", want: Preprocessing{AutoOrient: true, MaxEdge: 100, Flatten: true, Background: color.White}},
+		"spaces":  {steps: "orient, flatten", want: Preprocessing{AutoOrient: true, Flatten: true, Background: color.White}},
+		"none":    {steps: "none", want: Preprocessing{}},
+		"empty":   {steps: "", want: Preprocessing{}},
+		"unknown": {steps: "orient,sharpen", wantErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParsePreprocessing(test.steps, 100, color.White)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("got %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	if got, err := ParseColor("#102030"); err != nil || got != (color.RGBA{R: 0x10, G: 0x20, B: 0x30, A: 0xFF}) {
+		t.Errorf("got %v, %v", got, err)
+	}
+	if _, err := ParseColor("white"); err == nil {
+		t.Error("expected error for a colour name")
+	}
+}
@@ -0,0 +1,266 @@
+package jobs
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"imagetag/internal/tagging"
+	"log"
+	"mime/multipart"
+	"sync"
+	"time"
+)
+
+// DefaultRetention is how long finished jobs are kept when no retention is configured.
+const DefaultRetention = 10 * time.Minute
+
+// DefaultMaxHold is how long a job may hold its turn with the backend when no limit is configured.
+const DefaultMaxHold = 5 * time.Minute
+
+type Status string
+
+const STATUS_QUEUED Status = "queued"
+const STATUS_PENDING Status = "pending"
+const STATUS_COMPLETE Status = "complete"
+const STATUS_FAILED Status = "failed"
+const STATUS_CANCELLED Status = "cancelled"
+
+// Job is a snapshot of an asynchronous job.
+type Job struct {
+	Id          string
+	Status      Status
+	Result      tagging.JobResult
+	SubmittedAt time.Time
+	FinishedAt  time.Time
+}
+
+type JobNotFoundError struct {
+	Id string
+}
+
+func (e JobNotFoundError) Error() string {
+	return "job not found: " + e.Id
+}
+
+// Turn waits for a job's turn with the backend and returns the func which gives it up.  If the context ends first the
+// context's error is returned.
+type Turn func(ctx context.Context) (func(), error)
+
+type storedJob struct {
+	job Job
+	// ctx ends when the job is cancelled
+	ctx    context.Context
+	cancel context.CancelFunc
+	// adopted receives the result of a job adopted from a previous run while it was still pending
+	adopted chan tagging.JobResult
+}
+
+func buildStoredJob(job Job) *storedJob {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &storedJob{job: job, ctx: ctx, cancel: cancel}
+}
+
+// Store submits jobs to a Tagger without waiting on them, keeping each result for the retention window after it
+// arrives so that clients can poll for it.
+type Store struct {
+	tagger    tagging.Tagger
+	retention time.Duration
+	maxHold   time.Duration
+	jobs      map[string]*storedJob
+	mutex     sync.Mutex
+}
+
+// BuildStore builds a Store keeping finished jobs for retention.  A job gives up its turn with the backend after
+// maxHold even if its result hasn't arrived, so that jobs the backend never answers can't hold up everything else.
+func BuildStore(tagger tagging.Tagger, retention time.Duration, maxHold time.Duration) *Store {
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	if maxHold <= 0 {
+		maxHold = DefaultMaxHold
+	}
+	return &Store{
+		tagger:    tagger,
+		retention: retention,
+		maxHold:   maxHold,
+		jobs:      make(map[string]*storedJob),
+	}
+}
+
+// Submit queues the image and returns the job straight away.  The job waits for its turn, which starts straight away
+// when turn is nil, and is then submitted to the tagger, closing the image.  An IdentifiedTagger's job is given the
+// same id, so that results adopted after a restart can still be fetched.
+func (s *Store) Submit(imageFile multipart.File, model string, turn Turn) Job {
+	stored := buildStoredJob(Job{
+		Id:          uuid.New().String(),
+		Status:      STATUS_QUEUED,
+		SubmittedAt: time.Now(),
+	})
+	job := stored.job
+	s.mutex.Lock()
+	s.jobs[job.Id] = stored
+	s.mutex.Unlock()
+
+	go s.run(stored, imageFile, model, turn)
+	return job
+}
+
+// run waits for the job's turn, submits it and waits for its result or cancellation.
+func (s *Store) run(stored *storedJob, imageFile multipart.File, model string, turn Turn) {
+	release := func() {}
+	if turn != nil {
+		done, err := turn(stored.ctx)
+		if err != nil {
+			imageFile.Close()
+			s.finishUnsubmitted(stored, err)
+			return
+		}
+		release = sync.OnceFunc(done)
+	}
+	defer release()
+	if stored.ctx.Err() != nil {
+		// cancelled as its turn came
+		imageFile.Close()
+		s.finishUnsubmitted(stored, stored.ctx.Err())
+		return
+	}
+	hold := time.AfterFunc(s.maxHold, func() {
+		log.Printf("job %s has held its turn for %s without a result, giving it up", stored.job.Id, s.maxHold)
+		release()
+	})
+	defer hold.Stop()
+
+	submission, err := s.submit(stored.job.Id, imageFile, model)
+	imageFile.Close()
+	if err != nil {
+		s.finish(stored, STATUS_FAILED, tagging.JobResult{JobId: stored.job.Id, Error: err})
+		return
+	}
+	s.mutex.Lock()
+	stored.job.Status = STATUS_PENDING
+	s.mutex.Unlock()
+
+	select {
+	case result := <-submission.Results:
+		s.finish(stored, resultStatus(result), result)
+	case <-stored.ctx.Done():
+		submission.Cancel()
+		s.finish(stored, STATUS_CANCELLED, tagging.JobResult{})
+	}
+}
+
+func (s *Store) submit(id string, imageFile multipart.File, model string) (tagging.Submission, error) {
+	if identified, ok := s.tagger.(tagging.IdentifiedTagger); ok {
+		return identified.TagImageAs(id, imageFile, model)
+	}
+	return s.tagger.TagImage(imageFile, model)
+}
+
+// finishUnsubmitted finishes a job which stopped waiting for its turn, which is only a failure if it wasn't cancelled.
+func (s *Store) finishUnsubmitted(stored *storedJob, err error) {
+	if stored.ctx.Err() != nil {
+		s.finish(stored, STATUS_CANCELLED, tagging.JobResult{})
+		return
+	}
+	s.finish(stored, STATUS_FAILED, tagging.JobResult{JobId: stored.job.Id, Error: err})
+}
+
+// AdoptPending stores a job submitted before a restart as pending, so that it can be polled by its id until its result
+// is adopted.
+func (s *Store) AdoptPending(id string, submittedAt time.Time) {
+	stored := buildStoredJob(Job{
+		Id:          id,
+		Status:      STATUS_PENDING,
+		SubmittedAt: submittedAt,
+	})
+	stored.adopted = make(chan tagging.JobResult, 1)
+	s.mutex.Lock()
+	s.jobs[id] = stored
+	s.mutex.Unlock()
+
+	go func() {
+		select {
+		case result := <-stored.adopted:
+			s.finish(stored, resultStatus(result), result)
+		case <-stored.ctx.Done():
+			s.finish(stored, STATUS_CANCELLED, tagging.JobResult{})
+		}
+	}()
+}
+
+// Adopt stores a result which arrived without a waiting request, so that it can be fetched by its id.  A job adopted
+// as pending is finished with it, unless it was cancelled.
+func (s *Store) Adopt(id string, result tagging.JobResult) {
+	s.mutex.Lock()
+	pending, exists := s.jobs[id]
+	s.mutex.Unlock()
+	if exists && pending.adopted != nil {
+		select {
+		case pending.adopted <- result:
+		default:
+			// already has a result
+		}
+		return
+	}
+
+	stored := buildStoredJob(Job{
+		Id:          id,
+		Status:      STATUS_PENDING,
+		SubmittedAt: result.SubmittedAt,
+	})
+	s.mutex.Lock()
+	s.jobs[id] = stored
+	s.mutex.Unlock()
+	s.finish(stored, resultStatus(result), result)
+}
+
+func resultStatus(result tagging.JobResult) Status {
+	if result.Error != nil {
+		return STATUS_FAILED
+	}
+	return STATUS_COMPLETE
+}
+
+func (s *Store) finish(stored *storedJob, status Status, result tagging.JobResult) {
+	stored.cancel()
+	s.mutex.Lock()
+	stored.job.Status = status
+	stored.job.Result = result
+	stored.job.FinishedAt = time.Now()
+	s.mutex.Unlock()
+
+	time.AfterFunc(s.retention, func() {
+		s.mutex.Lock()
+		// only remove it if it hasn't since been replaced
+		if s.jobs[stored.job.Id] == stored {
+			delete(s.jobs, stored.job.Id)
+		}
+		s.mutex.Unlock()
+	})
+}
+
+func (s *Store) Get(id string) (Job, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, exists := s.jobs[id]
+	if !exists {
+		return Job{}, JobNotFoundError{Id: id}
+	}
+	return stored.job, nil
+}
+
+// Cancel abandons a queued or pending job, which remains visible as cancelled for the retention window.  A finished
+// job is removed immediately.
+func (s *Store) Cancel(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, exists := s.jobs[id]
+	if !exists {
+		return JobNotFoundError{Id: id}
+	}
+	if stored.job.Status != STATUS_QUEUED && stored.job.Status != STATUS_PENDING {
+		delete(s.jobs, id)
+		return nil
+	}
+	stored.cancel()
+	return nil
+}
@@ -0,0 +1,338 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"imagetag/internal/tagging"
+	"mime/multipart"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeTagger struct {
+	results   chan tagging.JobResult
+	cancelled atomic.Bool
+	nextId    atomic.Int64
+}
+
+func buildFakeTagger() *fakeTagger {
+	return &fakeTagger{results: make(chan tagging.JobResult, 1)}
+}
+
+func (f *fakeTagger) TagImage(imageFile multipart.File, model string) (tagging.Submission, error) {
+	if model == "not-allowed" {
+		return tagging.Submission{}, tagging.ModelNotAllowedError{Model: model}
+	}
+	return tagging.Submission{
+		JobId:   fmt.Sprintf("job-%d", f.nextId.Add(1)),
+		Results: f.results,
+		Cancel:  func() { f.cancelled.Store(true) },
+	}, nil
+}
+
+func (f *fakeTagger) Validate(imageFile multipart.File, model string) error {
+	return nil
+}
+
+func (f *fakeTagger) AllowedModels() []string {
+	return []string{"model-a"}
+}
+
+// waitForStatus polls the store until the job has the wanted status.
+func waitForStatus(t *testing.T, s *Store, id string, want Status) Job {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		job, err := s.Get(id)
+		if err == nil && job.Status == want {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for status %s", want)
+	return Job{}
+}
+
+// fakeFile is an image whose closing is recorded.
+type fakeFile struct {
+	multipart.File
+	closed atomic.Bool
+}
+
+func (f *fakeFile) Close() error {
+	f.closed.Store(true)
+	return nil
+}
+
+// fakeTurn hands out turns as the test releases them, recording how many are held.
+type fakeTurn struct {
+	turns chan struct{}
+	held  atomic.Int64
+}
+
+func buildFakeTurn() *fakeTurn {
+	return &fakeTurn{turns: make(chan struct{}, 1)}
+}
+
+func (f *fakeTurn) wait(ctx context.Context) (func(), error) {
+	select {
+	case <-f.turns:
+		f.held.Add(1)
+		return func() { f.held.Add(-1) }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// waitForHeld polls the turn until the wanted number are held.
+func waitForHeld(t *testing.T, turn *fakeTurn, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for turn.held.Load() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d turns held, want %d", turn.held.Load(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestStore_Submit(t *testing.T) {
+	tests := map[string]struct {
+		result     tagging.JobResult
+		wantStatus Status
+	}{
+		"complete": {
+			result:     tagging.JobResult{Tags: []string{"cat"}},
+			wantStatus: STATUS_COMPLETE,
+		},
+		"failed": {
+			result:     tagging.JobResult{Error: errors.New("backend failed")},
+			wantStatus: STATUS_FAILED,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tagger := buildFakeTagger()
+			s := BuildStore(tagger, time.Minute, time.Minute)
+			file := &fakeFile{}
+
+			job := s.Submit(file, "", nil)
+			if job.Id == "" {
+				t.Error("expected the job to have an id")
+			}
+			if job.Status != STATUS_QUEUED {
+				t.Errorf("got status %s, want %s", job.Status, STATUS_QUEUED)
+			}
+
+			waitForStatus(t, s, job.Id, STATUS_PENDING)
+			if !file.closed.Load() {
+				t.Error("expected the image to be closed once it was submitted")
+			}
+			tagger.results <- test.result
+			job = waitForStatus(t, s, job.Id, test.wantStatus)
+			if !reflect.DeepEqual(job.Result, test.result) {
+				t.Errorf("got result %+v, want %+v", job.Result, test.result)
+			}
+			if job.FinishedAt.IsZero() {
+				t.Error("expected FinishedAt to be set")
+			}
+		})
+	}
+}
+
+// identifiedTagger is a fakeTagger which takes the job id it's given.
+type identifiedTagger struct {
+	*fakeTagger
+	ids chan string
+}
+
+func (f *identifiedTagger) TagImageAs(id string, imageFile multipart.File, model string) (tagging.Submission, error) {
+	f.ids <- id
+	return tagging.Submission{JobId: id, Results: f.results, Cancel: func() {}}, nil
+}
+
+func TestStore_Submit_IdentifiedTagger(t *testing.T) {
+	tagger := &identifiedTagger{fakeTagger: buildFakeTagger(), ids: make(chan string, 1)}
+	s := BuildStore(tagger, time.Minute, time.Minute)
+
+	job := s.Submit(&fakeFile{}, "", nil)
+
+	// so that the job can still be fetched when its result is adopted after a restart
+	if id := <-tagger.ids; id != job.Id {
+		t.Errorf("got tagger job id %s, want %s", id, job.Id)
+	}
+}
+
+func TestStore_SubmitError(t *testing.T) {
+	s := BuildStore(buildFakeTagger(), time.Minute, time.Minute)
+	turn := buildFakeTurn()
+	turn.turns <- struct{}{}
+	file := &fakeFile{}
+
+	job := s.Submit(file, "not-allowed", turn.wait)
+	job = waitForStatus(t, s, job.Id, STATUS_FAILED)
+	var notAllowed tagging.ModelNotAllowedError
+	if !errors.As(job.Result.Error, &notAllowed) {
+		t.Errorf("got %v, want ModelNotAllowedError", job.Result.Error)
+	}
+	if !file.closed.Load() {
+		t.Error("expected the image to be closed")
+	}
+	waitForHeld(t, turn, 0)
+}
+
+func TestStore_Submit_Turn(t *testing.T) {
+	tagger := buildFakeTagger()
+	s := BuildStore(tagger, time.Minute, time.Minute)
+	turn := buildFakeTurn()
+
+	job := s.Submit(&fakeFile{}, "", turn.wait)
+	time.Sleep(20 * time.Millisecond)
+	if job, _ := s.Get(job.Id); job.Status != STATUS_QUEUED {
+		t.Errorf("got status %s before the job's turn, want %s", job.Status, STATUS_QUEUED)
+	}
+
+	turn.turns <- struct{}{}
+	waitForStatus(t, s, job.Id, STATUS_PENDING)
+	if turn.held.Load() != 1 {
+		t.Error("the pending job doesn't hold its turn")
+	}
+	tagger.results <- tagging.JobResult{Tags: []string{"cat"}}
+	waitForStatus(t, s, job.Id, STATUS_COMPLETE)
+	waitForHeld(t, turn, 0)
+
+	// cancelled jobs give up their turn too
+	turn.turns <- struct{}{}
+	job = s.Submit(&fakeFile{}, "", turn.wait)
+	waitForStatus(t, s, job.Id, STATUS_PENDING)
+	if err := s.Cancel(job.Id); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, s, job.Id, STATUS_CANCELLED)
+	waitForHeld(t, turn, 0)
+}
+
+func TestStore_Submit_MaxHold(t *testing.T) {
+	tagger := buildFakeTagger()
+	s := BuildStore(tagger, time.Minute, 50*time.Millisecond)
+	turn := buildFakeTurn()
+	turn.turns <- struct{}{}
+
+	job := s.Submit(&fakeFile{}, "", turn.wait)
+	waitForStatus(t, s, job.Id, STATUS_PENDING)
+	waitForHeld(t, turn, 0)
+
+	// the job still takes its result after giving up its turn
+	tagger.results <- tagging.JobResult{Tags: []string{"cat"}}
+	waitForStatus(t, s, job.Id, STATUS_COMPLETE)
+}
+
+func TestStore_Cancel(t *testing.T) {
+	tagger := buildFakeTagger()
+	s := BuildStore(tagger, time.Minute, time.Minute)
+	job := s.Submit(&fakeFile{}, "", nil)
+	waitForStatus(t, s, job.Id, STATUS_PENDING)
+
+	if err := s.Cancel(job.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(t, s, job.Id, STATUS_CANCELLED)
+	if !tagger.cancelled.Load() {
+		t.Error("expected the tagger job to be cancelled")
+	}
+
+	// cancelling a finished job removes it
+	if err := s.Cancel(job.Id); err != nil {
+		t.Fatal(err)
+	}
+	var notFound JobNotFoundError
+	if _, err := s.Get(job.Id); !errors.As(err, &notFound) {
+		t.Errorf("got %v, want JobNotFoundError", err)
+	}
+}
+
+func TestStore_Cancel_Queued(t *testing.T) {
+	tagger := buildFakeTagger()
+	s := BuildStore(tagger, time.Minute, time.Minute)
+	file := &fakeFile{}
+	job := s.Submit(file, "", buildFakeTurn().wait)
+
+	if err := s.Cancel(job.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForStatus(t, s, job.Id, STATUS_CANCELLED)
+	if tagger.nextId.Load() != 0 {
+		t.Error("expected the queued job never to be submitted")
+	}
+	if !file.closed.Load() {
+		t.Error("expected the image to be closed")
+	}
+}
+
+func TestStore_Retention(t *testing.T) {
+	tagger := buildFakeTagger()
+	s := BuildStore(tagger, 50*time.Millisecond, time.Minute)
+	job := s.Submit(&fakeFile{}, "", nil)
+	tagger.results <- tagging.JobResult{Tags: []string{"cat"}}
+	waitForStatus(t, s, job.Id, STATUS_COMPLETE)
+
+	time.Sleep(200 * time.Millisecond)
+
+	var notFound JobNotFoundError
+	if _, err := s.Get(job.Id); !errors.As(err, &notFound) {
+		t.Errorf("got %v, want JobNotFoundError after retention", err)
+	}
+}
+
+func TestStore_Get_NotFound(t *testing.T) {
+	s := BuildStore(buildFakeTagger(), time.Minute, time.Minute)
+
+	var notFound JobNotFoundError
+	if _, err := s.Get("missing"); !errors.As(err, &notFound) {
+		t.Errorf("got %v, want JobNotFoundError", err)
+	}
+}
+
+func TestStore_AdoptPending(t *testing.T) {
+	s := BuildStore(buildFakeTagger(), time.Minute, time.Minute)
+	submittedAt := time.Now().Add(-time.Hour)
+	s.AdoptPending("left-over", submittedAt)
+
+	job, err := s.Get("left-over")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.Status != STATUS_PENDING || !job.SubmittedAt.Equal(submittedAt) {
+		t.Errorf("got %+v", job)
+	}
+
+	s.Adopt("left-over", tagging.JobResult{JobId: "left-over", Tags: []string{"cat"}})
+	job = waitForStatus(t, s, "left-over", STATUS_COMPLETE)
+	if !reflect.DeepEqual(job.Result.Tags, []string{"cat"}) {
+		t.Errorf("got tags %v", job.Result.Tags)
+	}
+	if !job.SubmittedAt.Equal(submittedAt) {
+		t.Errorf("got submitted at %v, want %v", job.SubmittedAt, submittedAt)
+	}
+}
+
+func TestStore_AdoptPending_Cancel(t *testing.T) {
+	s := BuildStore(buildFakeTagger(), time.Minute, time.Minute)
+	s.AdoptPending("left-over", time.Now())
+	if err := s.Cancel("left-over"); err != nil {
+		t.Fatal(err)
+	}
+	waitForStatus(t, s, "left-over", STATUS_CANCELLED)
+
+	// a result arriving afterwards doesn't undo the cancellation
+	s.Adopt("left-over", tagging.JobResult{JobId: "left-over", Tags: []string{"cat"}})
+	if job, _ := s.Get("left-over"); job.Status != STATUS_CANCELLED {
+		t.Errorf("got status %s, want %s", job.Status, STATUS_CANCELLED)
+	}
+}
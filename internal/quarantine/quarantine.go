@@ -0,0 +1,153 @@
+package quarantine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type Reason string
+
+// REASON_MALFORMED_NAME is a result file which isn't named <job id>.<ext>.
+const REASON_MALFORMED_NAME Reason = "malformed_name"
+
+// REASON_UNDECODABLE is a result file which never became a valid result document.
+const REASON_UNDECODABLE Reason = "undecodable"
+
+// REASON_UNMATCHED is a result for a job which nobody is waiting for.
+const REASON_UNMATCHED Reason = "unmatched"
+
+// REASON_ORPHANED is a job package or result left over from a previous run, archived at startup.
+const REASON_ORPHANED Reason = "orphaned"
+
+const sidecarSuffix = ".reason.json"
+
+// Entry describes a quarantined file.  It's stored as a sidecar json file next to the quarantined file.
+type Entry struct {
+	Filename      string    `json:"filename"`
+	OriginalPath  string    `json:"original_path"`
+	Reason        Reason    `json:"reason"`
+	Detail        string    `json:"detail"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+}
+
+// Quarantine is a dead-letter directory for files which couldn't be delivered, kept so that operators can tell
+// whether the backend or imagetag is misbehaving.
+type Quarantine struct {
+	Path string
+}
+
+func BuildQuarantine(path string) (*Quarantine, error) {
+	path = filepath.Clean(path)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, fmt.Errorf("could not create quarantine directory: %s", err)
+	}
+	return &Quarantine{Path: path}, nil
+}
+
+// Move moves the file into quarantine and writes its sidecar reason file.
+func (q *Quarantine) Move(filePath string, reason Reason, detail string) (Entry, error) {
+	now := time.Now()
+	entry := Entry{
+		Filename:      fmt.Sprintf("%d-%s", now.UnixNano(), filepath.Base(filePath)),
+		OriginalPath:  filePath,
+		Reason:        reason,
+		Detail:        detail,
+		QuarantinedAt: now,
+	}
+	target := filepath.Join(q.Path, entry.Filename)
+	if err := moveFile(filePath, target); err != nil {
+		return entry, fmt.Errorf("could not move %s to quarantine: %s", filePath, err)
+	}
+	content, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return entry, fmt.Errorf("could not encode reason: %s", err)
+	}
+	if err := os.WriteFile(target+sidecarSuffix, content, 0644); err != nil {
+		return entry, fmt.Errorf("could not write reason: %s", err)
+	}
+	return entry, nil
+}
+
+// List returns the quarantined files, oldest first.
+func (q *Quarantine) List() ([]Entry, error) {
+	dirEntries, err := os.ReadDir(q.Path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read quarantine directory: %s", err)
+	}
+	entries := []Entry{}
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() || !strings.HasSuffix(dirEntry.Name(), sidecarSuffix) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(q.Path, dirEntry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("could not read %s: %s", dirEntry.Name(), err)
+		}
+		var entry Entry
+		if err := json.Unmarshal(content, &entry); err != nil {
+			return nil, fmt.Errorf("could not decode %s: %s", dirEntry.Name(), err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].QuarantinedAt.Before(entries[j].QuarantinedAt)
+	})
+	return entries, nil
+}
+
+// Purge removes quarantined files which were quarantined before the cutoff, returning how many were removed.
+func (q *Quarantine) Purge(before time.Time) (int, error) {
+	entries, err := q.List()
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, entry := range entries {
+		if !entry.QuarantinedAt.Before(before) {
+			continue
+		}
+		target := filepath.Join(q.Path, entry.Filename)
+		if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return purged, fmt.Errorf("could not remove %s: %s", entry.Filename, err)
+		}
+		if err := os.Remove(target + sidecarSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return purged, fmt.Errorf("could not remove reason for %s: %s", entry.Filename, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// moveFile renames the file, falling back to copying it when the quarantine is on another filesystem.
+func moveFile(source string, target string) error {
+	if err := os.Rename(source, target); err == nil {
+		return nil
+	}
+	in, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(target)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(target)
+		return err
+	}
+	in.Close()
+	return os.Remove(source)
+}
@@ -0,0 +1,105 @@
+package quarantine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestQuarantine_Move(t *testing.T) {
+	q, err := BuildQuarantine(filepath.Join(t.TempDir(), "quarantine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := writeTestFile(t, t.TempDir(), "abc.json", `{"job_id": "abc"}`)
+
+	entry, err := q.Move(source, REASON_UNMATCHED, "no job waiting")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(source); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be moved, got %v", source, err)
+	}
+	content, err := os.ReadFile(filepath.Join(q.Path, entry.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != `{"job_id": "abc"}` {
+		t.Errorf("got content %s", content)
+	}
+	entries, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("got %d entries, want 1", len(entries))
+	}
+	if entries[0].Reason != REASON_UNMATCHED || entries[0].Detail != "no job waiting" || entries[0].OriginalPath != source {
+		t.Errorf("got entry %+v", entries[0])
+	}
+}
+
+func TestQuarantine_Purge(t *testing.T) {
+	tests := map[string]struct {
+		before     func() time.Time
+		wantPurged int
+		wantLeft   int
+	}{
+		"purge all": {
+			before:     func() time.Time { return time.Now().Add(time.Minute) },
+			wantPurged: 2,
+			wantLeft:   0,
+		},
+		"purge none": {
+			before:     func() time.Time { return time.Now().Add(-time.Minute) },
+			wantPurged: 0,
+			wantLeft:   2,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			q, err := BuildQuarantine(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			sourceDir := t.TempDir()
+			if _, err := q.Move(writeTestFile(t, sourceDir, "a.json", "{}"), REASON_UNMATCHED, ""); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := q.Move(writeTestFile(t, sourceDir, "b.c.json", "{}"), REASON_MALFORMED_NAME, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			purged, err := q.Purge(test.before())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != test.wantPurged {
+				t.Errorf("got %d purged, want %d", purged, test.wantPurged)
+			}
+			entries, err := q.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != test.wantLeft {
+				t.Errorf("got %d left, want %d", len(entries), test.wantLeft)
+			}
+			files, _ := os.ReadDir(q.Path)
+			if len(files) != test.wantLeft*2 {
+				t.Errorf("got %d files left, want %d", len(files), test.wantLeft*2)
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package tagging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type ErrorCode string
+
+// ERROR_INVALID_IMAGE means interrogate_forever couldn't read the image, eg it's corrupt.
+const ERROR_INVALID_IMAGE ErrorCode = "invalid_image"
+
+// ERROR_UNSUPPORTED_MODEL means interrogate_forever doesn't have the model, even though it's allowed here.
+const ERROR_UNSUPPORTED_MODEL ErrorCode = "unsupported_model"
+
+// ERROR_INVALID_RESULT means interrogate_forever's result file couldn't be read.
+const ERROR_INVALID_RESULT ErrorCode = "invalid_result"
+
+// ERROR_BACKEND is any other failure reported by interrogate_forever.
+const ERROR_BACKEND ErrorCode = "backend_error"
+
+// BackendError is a job failure reported by the tagging backend.
+type BackendError struct {
+	Code    ErrorCode
+	Message string
+	JobId   string
+}
+
+func (e BackendError) Error() string {
+	return fmt.Sprintf("job %s failed (%s): %s", e.JobId, e.Code, e.Message)
+}
+
+// backendErrorPatterns maps phrases found in interrogate_forever's error strings to error codes, checked in order.  Only
+// phrases which clearly blame the model choice or the image are matched, anything else is the backend's fault.
+var backendErrorPatterns = []struct {
+	pattern *regexp.Regexp
+	code    ErrorCode
+}{
+	{regexp.MustCompile(`\b(unknown|unsupported|no such) model\b`), ERROR_UNSUPPORTED_MODEL},
+	{regexp.MustCompile(`\bmodel (\S+ )?not found\b`), ERROR_UNSUPPORTED_MODEL},
+	{regexp.MustCompile(`cannot identify image file`), ERROR_INVALID_IMAGE},
+	{regexp.MustCompile(`image file is truncated`), ERROR_INVALID_IMAGE},
+	{regexp.MustCompile(`\b(corrupt|truncated|invalid) image\b`), ERROR_INVALID_IMAGE},
+	{regexp.MustCompile(`\b(cannot|could not|failed to|unable to) decode image\b`), ERROR_INVALID_IMAGE},
+}
+
+// classifyBackendError maps an error string from a result file to a BackendError.
+func classifyBackendError(jobId string, message string) BackendError {
+	lower := strings.ToLower(message)
+	for _, pattern := range backendErrorPatterns {
+		if pattern.pattern.MatchString(lower) {
+			return BackendError{Code: pattern.code, Message: message, JobId: jobId}
+		}
+	}
+	return BackendError{Code: ERROR_BACKEND, Message: message, JobId: jobId}
+}
@@ -0,0 +1,59 @@
+package tagging
+
+import "testing"
+
+func TestClassifyBackendError(t *testing.T) {
+	tests := map[string]struct {
+		message  string
+		wantCode ErrorCode
+	}{
+		"unsupported model": {
+			message:  "Model SmilingWolf/unknown not found",
+			wantCode: ERROR_UNSUPPORTED_MODEL,
+		},
+		"corrupt image": {
+			message:  "cannot identify image file '/tmp/abc.png'",
+			wantCode: ERROR_INVALID_IMAGE,
+		},
+		"truncated image": {
+			message:  "image file is truncated (12 bytes not processed)",
+			wantCode: ERROR_INVALID_IMAGE,
+		},
+		"unknown model": {
+			message:  "unknown model: model-z",
+			wantCode: ERROR_UNSUPPORTED_MODEL,
+		},
+		"undecodable image": {
+			message:  "failed to decode image: unexpected EOF",
+			wantCode: ERROR_INVALID_IMAGE,
+		},
+		"other": {
+			message:  "CUDA out of memory",
+			wantCode: ERROR_BACKEND,
+		},
+		"failure loading a model": {
+			message:  "CUDA out of memory while loading model",
+			wantCode: ERROR_BACKEND,
+		},
+		"failure processing images": {
+			message:  "error processing image batch",
+			wantCode: ERROR_BACKEND,
+		},
+		"model weights corrupt": {
+			message:  "model weights are corrupt, re-download them",
+			wantCode: ERROR_BACKEND,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := classifyBackendError("job-1", test.message)
+			if got.Code != test.wantCode {
+				t.Errorf("got code %s, want %s", got.Code, test.wantCode)
+			}
+			if got.Message != test.message || got.JobId != "job-1" {
+				t.Errorf("got %+v", got)
+			}
+		})
+	}
+}
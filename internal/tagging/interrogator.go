@@ -2,30 +2,53 @@ package tagging
 
 import (
 	"archive/zip"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/google/uuid"
+	"imagetag/internal/imaging"
+	"imagetag/internal/quarantine"
 	"io"
 	"log"
+	"log/slog"
 	"mime/multipart"
-	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"slices"
 	"sync"
 	"time"
 )
 
 type JobResult struct {
+	JobId string
 	Tags  []string
-	Error error
+	// TagDetails holds the same tags as Tags, along with scores and categories when the backend provides them.
+	TagDetails []Tag
+	// Model is the model which interrogate_forever reports having run.
+	Model       string
+	SubmittedAt time.Time
+	CompletedAt time.Time
+	// Format is the format the image was uploaded in, before any transcoding.
+	Format imaging.Format
+	// Cached is set when the result was answered from a cache rather than by the backend.
+	Cached bool
+	Error  error
 }
 
 type ResultFile struct {
-	JobId string   `json:"job_id"`
-	Model string   `json:"model"`
-	Tags  []string `json:"tags"`
-	Error string   `json:"error"`
+	JobId string `json:"job_id"`
+	Model string `json:"model"`
+	Tags  []Tag  `json:"tags"`
+	Error string `json:"error"`
+}
+
+// pendingJob is a submitted job which is waiting for its result file.
+type pendingJob struct {
+	results     chan JobResult
+	submittedAt time.Time
+	format      imaging.Format
 }
 
 type jobSpec struct {
@@ -34,81 +57,268 @@ type jobSpec struct {
 	InputImageFilename string `json:"input_image_filename"`
 }
 
-type InterrogateForever struct {
+var _ IdentifiedTagger = (*InterrogateForever)(nil)
+
+// DefaultRescanInterval is how often the output folder is fully scanned in case the watcher missed an event.
+const DefaultRescanInterval = 30 * time.Second
+
+// DefaultResultSettleInterval and DefaultResultMaxAttempts bound how long a result file may take to be completely
+// written.
+const DefaultResultSettleInterval = 50 * time.Millisecond
+const DefaultResultMaxAttempts = 40
+
+// cancelledRetention is how long a cancelled job is remembered, so that its late result is discarded quietly rather
+// than quarantined as unmatched.
+const cancelledRetention = time.Hour
+
+// adoptedRetention is how long an adopted job's result is waited for.
+const adoptedRetention = 24 * time.Hour
+
+// Config configures BuildAndStart.  Only InputPath and OutputPath are required.
+type Config struct {
 	InputPath  string
 	OutputPath string
-	jobs       map[string]chan JobResult
-	jobMutex   sync.Mutex
+	Models     []string
+	// Quarantine receives result files which can't be delivered.  They're deleted when it's nil.
+	Quarantine *quarantine.Quarantine
+	// NativeFormats are the image formats interrogate_forever reads, defaulting to imaging.DefaultNativeFormats.
+	NativeFormats []imaging.Format
+	// Preprocessing is applied to images before they're packaged.  ModelPreprocessing overrides it for some models.
+	Preprocessing      imaging.Preprocessing
+	ModelPreprocessing map[string]imaging.Preprocessing
+	// Limits bound the images which are accepted.  Zero fields are unlimited.
+	Limits imaging.Limits
+	// KeepMetadata passes EXIF, XMP, IPTC and text metadata through to the backend.  It's stripped by default.
+	KeepMetadata bool
 }
 
-func BuildAndStart(inputPath string, outputPath string) *InterrogateForever {
+type InterrogateForever struct {
+	InputPath      string
+	OutputPath     string
+	RescanInterval time.Duration
+	// ResultSettleInterval is the wait between checks of whether a result file is completely written, up to
+	// ResultMaxAttempts checks.
+	ResultSettleInterval time.Duration
+	ResultMaxAttempts    int
+	// Models is the allowlist of models which may be requested.  The first is used when none is requested.
+	Models []string
+	// Quarantine receives result files which can't be delivered.  They're deleted when it's nil.
+	Quarantine *quarantine.Quarantine
+	// NativeFormats are the image formats interrogate_forever reads.  Others are transcoded to png.
+	NativeFormats []imaging.Format
+	// Preprocessing is applied to images before they're packaged, unless ModelPreprocessing has the model.
+	Preprocessing      imaging.Preprocessing
+	ModelPreprocessing map[string]imaging.Preprocessing
+	// Limits bound the images which are accepted, checked before anything is queued.
+	Limits imaging.Limits
+	// KeepMetadata passes image metadata through to the job package rather than stripping it.
+	KeepMetadata bool
+	jobs         map[string]pendingJob
+	// cancelled holds when recently cancelled jobs were cancelled, guarded by jobMutex.
+	cancelled map[string]time.Time
+	// adopted holds when jobs left over from a previous run were submitted, guarded by jobMutex.  Their results are
+	// given to adopter.
+	adopted  map[string]time.Time
+	adopter  Adopter
+	jobMutex sync.Mutex
+	// pending holds the result files currently being handled, so that repeated write events don't handle a file twice.
+	pending      map[string]struct{}
+	pendingMutex sync.Mutex
+	watcher      *fsnotify.Watcher
+	stop         chan struct{}
+	stopOnce     sync.Once
+	stopped      sync.WaitGroup
+}
+
+// Build builds an InterrogateForever which isn't yet watching for results, so that jobs left over from a previous run
+// may be reconciled before it's started.
+func Build(config Config) *InterrogateForever {
+	models := config.Models
+	if len(models) == 0 {
+		models = DefaultModels
+	}
+	nativeFormats := config.NativeFormats
+	if len(nativeFormats) == 0 {
+		nativeFormats = imaging.DefaultNativeFormats
+	}
 	i := InterrogateForever{
-		InputPath:  filepath.Clean(inputPath),
-		OutputPath: filepath.Clean(outputPath),
+		InputPath:            filepath.Clean(config.InputPath),
+		OutputPath:           filepath.Clean(config.OutputPath),
+		RescanInterval:       DefaultRescanInterval,
+		ResultSettleInterval: DefaultResultSettleInterval,
+		ResultMaxAttempts:    DefaultResultMaxAttempts,
+		Models:               models,
+		Quarantine:           config.Quarantine,
+		NativeFormats:        nativeFormats,
+		Preprocessing:        config.Preprocessing,
+		ModelPreprocessing:   config.ModelPreprocessing,
+		Limits:               config.Limits,
+		KeepMetadata:         config.KeepMetadata,
 	}
-	i.Start()
+	i.initJobs()
 	return &i
 }
 
-func (i *InterrogateForever) TagImage(imageFile multipart.File) (chan JobResult, func(), error) {
+func BuildAndStart(config Config) (*InterrogateForever, error) {
+	i := Build(config)
+	if err := i.Start(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
 
-	mimeType, err := detectMimeType(imageFile)
+func (i *InterrogateForever) initJobs() {
+	i.jobMutex.Lock()
+	defer i.jobMutex.Unlock()
+	if i.jobs == nil {
+		i.jobs = map[string]pendingJob{}
+		i.cancelled = map[string]time.Time{}
+		i.adopted = map[string]time.Time{}
+	}
+}
+
+func (i *InterrogateForever) Validate(imageFile multipart.File, model string) error {
+	_, _, err := i.validate(imageFile, model)
+	return err
+}
+
+// validate resolves the model and checks the image's format and limits, returning the model and format.
+func (i *InterrogateForever) validate(imageFile multipart.File, model string) (string, imaging.Format, error) {
+	model, err := ResolveModel(i.Models, model)
 	if err != nil {
-		return nil, nil, err
+		return "", "", err
 	}
-	extension, err := mimeToExtension(mimeType)
+	format, err := imaging.DetectFormat(imageFile)
 	if err != nil {
-		return nil, nil, err
+		return "", "", err
+	}
+	if _, err := imaging.Validate(imageFile, i.Limits); err != nil {
+		return "", "", err
+	}
+	return model, format, nil
+}
+
+func (i *InterrogateForever) TagImage(imageFile multipart.File, model string) (Submission, error) {
+	return i.TagImageAs(uuid.New().String(), imageFile, model)
+}
+
+func (i *InterrogateForever) TagImageAs(id string, imageFile multipart.File, model string) (Submission, error) {
+	model, format, err := i.validate(imageFile, model)
+	if err != nil {
+		return Submission{}, err
+	}
+	writeImage := copyImage(imageFile)
+	// images which are re-encoded lose their metadata, so only those left as they are need stripping
+	transcode := !slices.Contains(i.NativeFormats, format) || (!i.KeepMetadata && !imaging.CanStripMetadata(format))
+	processed, packagedFormat, err := imaging.Preprocess(imageFile, format, i.preprocessingFor(model), transcode)
+	if err != nil {
+		return Submission{}, err
+	}
+	if processed != nil {
+		writeImage = copyImage(bytes.NewReader(processed))
+	} else if !i.KeepMetadata {
+		writeImage = func(w io.Writer) error {
+			return imaging.StripMetadata(w, imageFile, format)
+		}
 	}
-	responseChan := make(chan JobResult)
-	id := uuid.New().String()
+	responseChan := make(chan JobResult, 1)
 	cancel := func() {
 		i.jobMutex.Lock()
-		delete(i.jobs, id)
+		if _, exists := i.jobs[id]; exists {
+			delete(i.jobs, id)
+			i.cancelled[id] = time.Now()
+		}
 		i.jobMutex.Unlock()
 	}
-	go func() {
+	imageFilename := fmt.Sprintf("%s.%s", id, packagedFormat.Extension())
+	// Listen for output before the job is created, so that a fast result isn't missed.
+	i.jobMutex.Lock()
+	i.jobs[id] = pendingJob{results: responseChan, submittedAt: time.Now(), format: format}
+	i.jobMutex.Unlock()
 
-		imageFilename := fmt.Sprintf("%s.%s", id, extension)
-		// Listen for output
-		i.jobMutex.Lock()
-		i.jobs[id] = responseChan
-		i.jobMutex.Unlock()
+	// The job is created before returning so that the caller may close the image as soon as TagImage returns.
+	if err := i.createJob(id, writeImage, imageFilename, model); err != nil {
+		cancel()
+		return Submission{}, err
+	}
+	return Submission{JobId: id, Results: responseChan, Cancel: cancel}, nil
+}
 
-		// Create file
-		err := i.createJob(id, imageFile, imageFilename)
-		if err != nil {
-			responseChan <- JobResult{nil, err}
-		}
-	}()
-	// block until it's ready, so that it doesn't risk sending a response before it's ready
-	return responseChan, cancel, nil
+// preprocessingFor is the preprocessing applied to images for the model.
+func (i *InterrogateForever) preprocessingFor(model string) imaging.Preprocessing {
+	if p, ok := i.ModelPreprocessing[model]; ok {
+		return p
+	}
+	return i.Preprocessing
+}
+
+func (i *InterrogateForever) AllowedModels() []string {
+	return i.Models
 }
 
-func (i *InterrogateForever) createJob(jobId string, imageFile multipart.File, imageFilename string) error {
+// stagingPrefix marks job packages which are still being written.  interrogate_forever only picks up .zip files.
+const stagingPrefix = ".staging-"
+
+// copyImage writes the image to the job package as it is.
+func copyImage(imageFile io.Reader) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.Copy(w, imageFile)
+		return err
+	}
+}
+
+// createJob writes the job package to a staging file alongside its final path, syncs it to disk and then renames it
+// into place, so that interrogate_forever never sees a partially written package.  writeImage writes the image into
+// the package.
+func (i *InterrogateForever) createJob(jobId string, writeImage func(io.Writer) error, imageFilename string, model string) error {
 	zipFilename := fmt.Sprintf("%s.zip", jobId)
 	targetPath := filepath.Join(i.InputPath, zipFilename)
-	zipFile, err := os.Create(targetPath)
+	zipFile, err := os.CreateTemp(i.InputPath, stagingPrefix+jobId+"-*.tmp")
 	if err != nil {
 		return fmt.Errorf("could not create zip file: %s", err)
 	}
-	defer zipFile.Close()
+	stagingPath := zipFile.Name()
+	published := false
+	defer func() {
+		if !published {
+			zipFile.Close()
+			if err := os.Remove(stagingPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("could not remove staging file %s: %s", stagingPath, err)
+			}
+		}
+	}()
 
-	zipWriter := zip.NewWriter(zipFile)
-	defer zipWriter.Close()
+	if err := writeJobPackage(zipFile, jobId, writeImage, imageFilename, model); err != nil {
+		return err
+	}
+	if err := zipFile.Sync(); err != nil {
+		return fmt.Errorf("could not sync zip file: %s", err)
+	}
+	if err := zipFile.Close(); err != nil {
+		return fmt.Errorf("could not close zip file: %s", err)
+	}
+	if err := os.Rename(stagingPath, targetPath); err != nil {
+		return fmt.Errorf("could not publish zip file: %s", err)
+	}
+	published = true
+	syncDir(i.InputPath)
+	return nil
+}
+
+func writeJobPackage(w io.Writer, jobId string, writeImage func(io.Writer) error, imageFilename string, model string) error {
+	zipWriter := zip.NewWriter(w)
 
 	imageWriter, err := zipWriter.Create(imageFilename)
 	if err != nil {
 		return fmt.Errorf("could not create image file: %s", err)
 	}
-	if _, err := io.Copy(imageWriter, imageFile); err != nil {
-		return fmt.Errorf("could not copy image file: %s", err)
+	if err := writeImage(imageWriter); err != nil {
+		return fmt.Errorf("could not copy image file: %w", err)
 	}
 
 	// Add the job spec json to the zip
-	validModel := "SmilingWolf/wd-vit-large-tagger-v3"
 	job := jobSpec{
-		ModelName:          validModel,
+		ModelName:          model,
 		JobId:              jobId,
 		InputImageFilename: imageFilename,
 	}
@@ -121,128 +331,240 @@ func (i *InterrogateForever) createJob(jobId string, imageFile multipart.File, i
 		return fmt.Errorf("could not encode job: %s", err)
 	}
 
+	if err := zipWriter.Close(); err != nil {
+		return fmt.Errorf("could not finish zip file: %s", err)
+	}
 	return nil
+}
 
+// syncDir makes a rename within the directory durable.  Failure is logged rather than returned, since the package has
+// already been published.
+func syncDir(dirPath string) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		log.Printf("could not open %s to sync: %s", dirPath, err)
+		return
+	}
+	defer dir.Close()
+	if err := dir.Sync(); err != nil {
+		log.Printf("could not sync %s: %s", dirPath, err)
+	}
 }
 
-func (i *InterrogateForever) Start() {
-	i.jobs = map[string]chan JobResult{}
-	lastState := map[string]time.Time{}
-	go func() {
-		for {
-			entries, err := os.ReadDir(i.OutputPath)
-			if err != nil {
-				log.Printf("Error reading directory: %s", err)
-				time.Sleep(1 * time.Second)
-				continue
-			}
+func (i *InterrogateForever) Start() error {
+	i.initJobs()
+	i.pending = map[string]struct{}{}
+	if i.RescanInterval <= 0 {
+		i.RescanInterval = DefaultRescanInterval
+	}
+	if i.ResultSettleInterval <= 0 {
+		i.ResultSettleInterval = DefaultResultSettleInterval
+	}
+	if i.ResultMaxAttempts <= 0 {
+		i.ResultMaxAttempts = DefaultResultMaxAttempts
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not create watcher: %s", err)
+	}
+	if err := watcher.Add(i.OutputPath); err != nil {
+		watcher.Close()
+		return fmt.Errorf("could not watch %s: %s", i.OutputPath, err)
+	}
+	i.watcher = watcher
+	i.stop = make(chan struct{})
 
-			currentState := map[string]time.Time{}
-			for _, entry := range entries {
-				info, err := entry.Info()
-				if err != nil {
-					log.Printf("Error getting file info: %s", err)
-					continue
-				}
-
-				currentState[info.Name()] = info.ModTime()
-				if modTime, ok := lastState[info.Name()]; !ok || modTime != info.ModTime() {
-					fullPath := filepath.Join(i.OutputPath, info.Name())
-					go i.HandleResponse(fullPath)
-				}
-			}
+	i.stopped.Add(1)
+	go i.watch()
+	// Pick up anything written before the watcher was started.
+	i.rescan()
+	return nil
+}
 
-			lastState = currentState
-			time.Sleep(50 * time.Millisecond)
+// Stop stops watching the output folder and waits for in-progress results to be handled.  It may be called more than
+// once.
+func (i *InterrogateForever) Stop() {
+	i.stopOnce.Do(func() {
+		close(i.stop)
+		i.stopped.Wait()
+		if err := i.watcher.Close(); err != nil {
+			log.Printf("could not close watcher: %s", err)
+		}
+	})
+}
 
+func (i *InterrogateForever) watch() {
+	defer i.stopped.Done()
+	ticker := time.NewTicker(i.RescanInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-i.stop:
+			return
+		case event, ok := <-i.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) {
+				i.queueResponse(event.Name)
+			}
+		case err, ok := <-i.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watcher error: %s", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				i.rescan()
+			}
+		case <-ticker.C:
+			i.rescan()
+			i.forgetCancelled(time.Now().Add(-cancelledRetention))
+			i.forgetAdopted(time.Now().Add(-adoptedRetention))
 		}
-	}()
+	}
+}
 
+// rescan queues every file in the output folder, as a safety net for events the watcher missed.
+func (i *InterrogateForever) rescan() {
+	entries, err := os.ReadDir(i.OutputPath)
+	if err != nil {
+		log.Printf("Error reading directory: %s", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		i.queueResponse(filepath.Join(i.OutputPath, entry.Name()))
+	}
+}
+
+// queueResponse handles the result file in the background, unless it's already being handled.
+func (i *InterrogateForever) queueResponse(filePath string) {
+	i.pendingMutex.Lock()
+	if _, exists := i.pending[filePath]; exists {
+		i.pendingMutex.Unlock()
+		return
+	}
+	i.pending[filePath] = struct{}{}
+	i.pendingMutex.Unlock()
+
+	i.stopped.Add(1)
+	go func() {
+		defer i.stopped.Done()
+		i.HandleResponse(filePath)
+		i.pendingMutex.Lock()
+		delete(i.pending, filePath)
+		i.pendingMutex.Unlock()
+	}()
 }
 
 func (i *InterrogateForever) HandleResponse(filePath string) {
-	time.Sleep(100 * time.Millisecond)
 	filename := filepath.Base(filePath)
-	parts := strings.Split(filename, ".")
-	if len(parts) != 2 {
-		log.Printf("file not named correctly: %s", filename)
-		// todo: error and delete
+	if isHandoffFile(filename) {
+		// still being written, it'll be handled once it's renamed into place
+		return
 	}
-	id := parts[0]
-	file, err := os.Open(filePath)
-	if err != nil {
-		// todo: delete it
-		i.respondError(id, err)
-		log.Printf("could not open file: %s", err)
+	id, ok := parseResultFilename(filename)
+	if !ok {
+		i.discardResult(filePath, "", quarantine.REASON_MALFORMED_NAME, "expected <job id>.<ext>")
+		return
 	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-
-	var resultFile ResultFile
 
-	err = decoder.Decode(&resultFile)
+	resultFile, err := i.readResultFile(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		// already handled
+		return
+	}
 	if err != nil {
-		i.respondError(id, err)
-		log.Printf("could not decode file: %s", err)
+		i.respondError(id, BackendError{Code: ERROR_INVALID_RESULT, Message: err.Error(), JobId: id})
+		i.discardResult(filePath, id, quarantine.REASON_UNDECODABLE, err.Error())
+		return
+	}
+	var delivered bool
+	if resultFile.Error != "" {
+		delivered = i.respondError(id, classifyBackendError(id, resultFile.Error))
+	} else {
+		delivered = i.respondSuccess(id, resultFile.Model, resultFile.Tags)
+	}
+	if !delivered && !i.forgetCancelledJob(id) {
+		i.discardResult(filePath, id, quarantine.REASON_UNMATCHED, "no job is waiting for this result")
+		return
 	}
-	i.respondSuccess(id, resultFile.Tags)
-	file.Close()
 	if err := os.Remove(filePath); err != nil {
 		log.Printf("could not remove file: %s", err)
 	}
 
 }
 
-func (i *InterrogateForever) respondSuccess(id string, tags []string) {
-	response := JobResult{
-		Tags:  tags,
-		Error: nil,
+// discardResult moves a result file which couldn't be delivered into quarantine, or deletes it if there's no
+// quarantine.
+func (i *InterrogateForever) discardResult(filePath string, id string, reason quarantine.Reason, detail string) {
+	logger := slog.With("file", filepath.Base(filePath), "job_id", id, "reason", reason, "detail", detail)
+	if i.Quarantine == nil {
+		logger.Warn("deleting result file")
+		if err := os.Remove(filePath); err != nil {
+			logger.Error("could not delete result file", "error", err)
+		}
+		return
 	}
-	i.SendResponse(id, response)
-}
-
-func (i *InterrogateForever) respondError(id string, err error) {
-	response := JobResult{
-		Error: err,
+	entry, err := i.Quarantine.Move(filePath, reason, detail)
+	if err != nil {
+		logger.Error("could not quarantine result file", "error", err)
+		return
 	}
-	i.SendResponse(id, response)
+	logger.Warn("quarantined result file", "quarantined_as", entry.Filename)
 }
 
-func (i *InterrogateForever) SendResponse(id string, response JobResult) {
+// forgetCancelledJob reports whether the job was cancelled, forgetting it.
+func (i *InterrogateForever) forgetCancelledJob(id string) bool {
 	i.jobMutex.Lock()
-	ch, exists := i.jobs[id]
-	if exists {
+	defer i.jobMutex.Unlock()
+	_, cancelled := i.cancelled[id]
+	delete(i.cancelled, id)
+	return cancelled
+}
 
-		ch <- response
-		delete(i.jobs, id)
+// forgetCancelled forgets jobs cancelled before the cutoff.
+func (i *InterrogateForever) forgetCancelled(before time.Time) {
+	i.jobMutex.Lock()
+	defer i.jobMutex.Unlock()
+	for id, cancelledAt := range i.cancelled {
+		if cancelledAt.Before(before) {
+			delete(i.cancelled, id)
+		}
 	}
-	i.jobMutex.Unlock()
 }
 
-func detectMimeType(file multipart.File) (string, error) {
-	buffer := make([]byte, 512)
-	_, err := file.Read(buffer)
-	if err != nil && err != io.EOF {
-		return "", fmt.Errorf("failed to read file: %v", err)
+func (i *InterrogateForever) respondSuccess(id string, model string, tags []Tag) bool {
+	response := JobResult{
+		Tags:       tagNames(tags),
+		TagDetails: tags,
+		Model:      model,
+		Error:      nil,
 	}
+	return i.SendResponse(id, response) || i.sendAdopted(id, response)
+}
 
-	mimeType := http.DetectContentType(buffer)
-
-	// reset file pointer to beginning
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
-		return "", fmt.Errorf("failed to reset file pointer: %v", err)
+func (i *InterrogateForever) respondError(id string, err error) bool {
+	response := JobResult{
+		Error: err,
 	}
-	return mimeType, nil
+	return i.SendResponse(id, response) || i.sendAdopted(id, response)
 }
 
-func mimeToExtension(mimeType string) (string, error) {
-	switch mimeType {
-	case "image/png":
-		return "png", nil
-	case "image/jpeg":
-		return "jpg", nil
-	default:
-		return "", fmt.Errorf("unsupported file type: %s", mimeType)
+// SendResponse delivers the response to the job's waiting request, reporting whether anything was waiting.
+func (i *InterrogateForever) SendResponse(id string, response JobResult) bool {
+	i.jobMutex.Lock()
+	job, exists := i.jobs[id]
+	if exists {
+		response.JobId = id
+		response.SubmittedAt = job.submittedAt
+		response.Format = job.format
+		response.CompletedAt = time.Now()
+		job.results <- response
+		delete(i.jobs, id)
 	}
+	i.jobMutex.Unlock()
+	return exists
 }
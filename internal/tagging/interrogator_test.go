@@ -0,0 +1,416 @@
+package tagging
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"imagetag/internal/imaging"
+	"imagetag/internal/quarantine"
+	"io"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testPng is a 1x1 png.
+var testPng = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\b\x00\x00\x00\x00:~\x9bU\x00\x00\x00\x0fIDATx\x9c\x00\x02\x00\xfd\xff\x02\x00\x03\x00\x00\x06\x00\x03!\xfc\xac\x06\x00\x00\x00\x00IEND\xaeB`\x82")
+
+func buildTestInterrogator(t *testing.T) *InterrogateForever {
+	t.Helper()
+	q, err := quarantine.BuildQuarantine(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := BuildAndStart(Config{
+		InputPath:  t.TempDir(),
+		OutputPath: t.TempDir(),
+		Models:     []string{"model-a", "model-b"},
+		Quarantine: q,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(i.Stop)
+	return i
+}
+
+func openTestImage(t *testing.T, content []byte) *os.File {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload")
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+// waitForJob waits for a job package to appear in the input folder and returns its spec.
+func waitForJob(t *testing.T, inputPath string) jobSpec {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		matches, _ := filepath.Glob(filepath.Join(inputPath, "*.zip"))
+		if len(matches) == 1 {
+			if spec, err := readJobSpec(matches[0]); err == nil {
+				return spec
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for job package")
+	return jobSpec{}
+}
+
+func readJobSpec(zipPath string) (jobSpec, error) {
+	var spec jobSpec
+	r, err := zip.OpenReader(zipPath)
+	if err != nil {
+		return spec, err
+	}
+	defer r.Close()
+	f, err := r.Open("job.json")
+	if err != nil {
+		return spec, err
+	}
+	defer f.Close()
+	err = json.NewDecoder(f).Decode(&spec)
+	return spec, err
+}
+
+// readJobImage reads the image from the job's package.
+func readJobImage(t *testing.T, inputPath string, spec jobSpec) []byte {
+	t.Helper()
+	r, err := zip.OpenReader(filepath.Join(inputPath, spec.JobId+".zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	f, err := r.Open(spec.InputImageFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+func writeResultFile(t *testing.T, outputPath string, result ResultFile) {
+	t.Helper()
+	content, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(outputPath, result.JobId+".json"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInterrogateForever_TagImage(t *testing.T) {
+	i := buildTestInterrogator(t)
+
+	submission, err := i.TagImage(openTestImage(t, testPng), "model-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer submission.Cancel()
+
+	spec := waitForJob(t, i.InputPath)
+	if spec.ModelName != "model-b" {
+		t.Errorf("got model %s in job spec, want model-b", spec.ModelName)
+	}
+	wantTags := []string{"cat", "outdoors"}
+	writeResultFile(t, i.OutputPath, ResultFile{
+		JobId: spec.JobId,
+		Model: spec.ModelName,
+		Tags:  []Tag{{Name: "cat"}, {Name: "outdoors"}},
+	})
+
+	select {
+	case result := <-submission.Results:
+		if result.Error != nil {
+			t.Fatalf("unexpected error: %v", result.Error)
+		}
+		if !reflect.DeepEqual(result.Tags, wantTags) {
+			t.Errorf("got %v, want %v", result.Tags, wantTags)
+		}
+		if result.JobId != spec.JobId {
+			t.Errorf("got job id %s, want %s", result.JobId, spec.JobId)
+		}
+		if result.CompletedAt.Before(result.SubmittedAt) {
+			t.Errorf("completed at %v before submitted at %v", result.CompletedAt, result.SubmittedAt)
+		}
+		if result.Model != "model-b" {
+			t.Errorf("got model %s, want model-b", result.Model)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for result")
+	}
+}
+
+func TestInterrogateForever_TagImage_Transcoded(t *testing.T) {
+	i := buildTestInterrogator(t)
+	var content bytes.Buffer
+	if err := gif.Encode(&content, image.NewGray(image.Rect(0, 0, 2, 2)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	submission, err := i.TagImage(openTestImage(t, content.Bytes()), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer submission.Cancel()
+
+	spec := waitForJob(t, i.InputPath)
+	if filepath.Ext(spec.InputImageFilename) != ".png" {
+		t.Errorf("got image %s in job spec, want a png", spec.InputImageFilename)
+	}
+	writeResultFile(t, i.OutputPath, ResultFile{JobId: spec.JobId, Model: spec.ModelName})
+
+	select {
+	case result := <-submission.Results:
+		if result.Format != imaging.FORMAT_GIF {
+			t.Errorf("got format %s, want gif", result.Format)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for result")
+	}
+}
+
+func TestInterrogateForever_TagImage_Preprocessing(t *testing.T) {
+	tests := map[string]struct {
+		model     string
+		wantWidth int
+	}{
+		"default":  {model: "model-a", wantWidth: 10},
+		"disabled": {model: "model-b", wantWidth: 40},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i, err := BuildAndStart(Config{
+				InputPath:          t.TempDir(),
+				OutputPath:         t.TempDir(),
+				Models:             []string{"model-a", "model-b"},
+				Preprocessing:      imaging.Preprocessing{MaxEdge: 10},
+				ModelPreprocessing: map[string]imaging.Preprocessing{"model-b": {}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(i.Stop)
+			var content bytes.Buffer
+			if err := png.Encode(&content, image.NewGray(image.Rect(0, 0, 40, 20))); err != nil {
+				t.Fatal(err)
+			}
+
+			submission, err := i.TagImage(openTestImage(t, content.Bytes()), test.model)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer submission.Cancel()
+
+			spec := waitForJob(t, i.InputPath)
+			config, err := png.DecodeConfig(bytes.NewReader(readJobImage(t, i.InputPath, spec)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config.Width != test.wantWidth {
+				t.Errorf("got width %d, want %d", config.Width, test.wantWidth)
+			}
+		})
+	}
+}
+
+func TestInterrogateForever_TagImage_Metadata(t *testing.T) {
+	var photo bytes.Buffer
+	if err := jpeg.Encode(&photo, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	comment := "GPS 51.5,-0.1"
+	// a comment segment after the start of image marker
+	content := append([]byte{0xFF, 0xD8, 0xFF, 0xFE, 0, byte(len(comment) + 2)}, comment...)
+	content = append(content, photo.Bytes()[2:]...)
+
+	tests := map[string]struct {
+		keepMetadata bool
+		wantComment  bool
+	}{
+		"stripped":     {keepMetadata: false, wantComment: false},
+		"passed along": {keepMetadata: true, wantComment: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i := buildTestInterrogator(t)
+			i.KeepMetadata = test.keepMetadata
+
+			submission, err := i.TagImage(openTestImage(t, content), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer submission.Cancel()
+
+			spec := waitForJob(t, i.InputPath)
+			packaged := readJobImage(t, i.InputPath, spec)
+			if got := bytes.Contains(packaged, []byte(comment)); got != test.wantComment {
+				t.Errorf("got comment in package %v, want %v", got, test.wantComment)
+			}
+		})
+	}
+}
+
+func TestInterrogateForever_TagImage_TooLarge(t *testing.T) {
+	i := buildTestInterrogator(t)
+	i.Limits = imaging.Limits{MaxDimension: 10}
+	var content bytes.Buffer
+	if err := png.Encode(&content, image.NewGray(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := i.TagImage(openTestImage(t, content.Bytes()), "")
+
+	var tooLarge imaging.ImageTooLargeError
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("got %v, want ImageTooLargeError", err)
+	}
+	entries, err := os.ReadDir(i.InputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d files in the input folder, want none queued", len(entries))
+	}
+}
+
+func TestInterrogateForever_TagImage_Unsupported(t *testing.T) {
+	i := buildTestInterrogator(t)
+
+	if _, err := i.TagImage(openTestImage(t, []byte("plain text")), ""); err == nil {
+		t.Error("expected error for unsupported file type")
+	}
+}
+
+func TestInterrogateForever_TagImage_ModelNotAllowed(t *testing.T) {
+	i := buildTestInterrogator(t)
+
+	_, err := i.TagImage(openTestImage(t, testPng), "model-z")
+	var notAllowed ModelNotAllowedError
+	if !errors.As(err, &notAllowed) {
+		t.Errorf("got %v, want ModelNotAllowedError", err)
+	}
+}
+
+func TestInterrogateForever_Validate(t *testing.T) {
+	i := buildTestInterrogator(t)
+	i.Limits = imaging.Limits{MaxDimension: 10}
+	var large bytes.Buffer
+	if err := png.Encode(&large, image.NewGray(image.Rect(0, 0, 40, 20))); err != nil {
+		t.Fatal(err)
+	}
+
+	var tooLarge imaging.ImageTooLargeError
+	if err := i.Validate(openTestImage(t, large.Bytes()), ""); !errors.As(err, &tooLarge) {
+		t.Errorf("got %v, want ImageTooLargeError", err)
+	}
+	var notAllowed ModelNotAllowedError
+	if err := i.Validate(openTestImage(t, testPng), "model-z"); !errors.As(err, &notAllowed) {
+		t.Errorf("got %v, want ModelNotAllowedError", err)
+	}
+	if err := i.Validate(openTestImage(t, []byte("plain text")), ""); err == nil {
+		t.Error("expected error for unsupported file type")
+	}
+
+	valid := openTestImage(t, testPng)
+	if err := i.Validate(valid, ""); err != nil {
+		t.Fatal(err)
+	}
+	if offset, _ := valid.Seek(0, io.SeekCurrent); offset != 0 {
+		t.Errorf("image was left at %d, want it rewound", offset)
+	}
+	entries, err := os.ReadDir(i.InputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("got %d files in the input folder, want nothing queued", len(entries))
+	}
+}
+
+// failingFile fails part way through being read.
+type failingFile struct {
+	multipart.File
+}
+
+func (f failingFile) Read(p []byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestInterrogateForever_CreateJob(t *testing.T) {
+	tests := map[string]struct {
+		imageFile func(t *testing.T) multipart.File
+		wantErr   bool
+		wantFiles []string
+	}{
+		"published": {
+			imageFile: func(t *testing.T) multipart.File {
+				return openTestImage(t, testPng)
+			},
+			wantErr:   false,
+			wantFiles: []string{"job-1.zip"},
+		},
+		"read failure cleans up": {
+			imageFile: func(t *testing.T) multipart.File {
+				return failingFile{openTestImage(t, testPng)}
+			},
+			wantErr:   true,
+			wantFiles: []string{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i := buildTestInterrogator(t)
+
+			err := i.createJob("job-1", copyImage(test.imageFile(t)), "job-1.png", "model-a")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, test.wantErr)
+			}
+
+			entries, err := os.ReadDir(i.InputPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotFiles := []string{}
+			for _, entry := range entries {
+				gotFiles = append(gotFiles, entry.Name())
+			}
+			if !reflect.DeepEqual(gotFiles, test.wantFiles) {
+				t.Errorf("got files %v, want %v", gotFiles, test.wantFiles)
+			}
+		})
+	}
+}
+
+func TestInterrogateForever_StopTwice(t *testing.T) {
+	i := Build(Config{InputPath: t.TempDir(), OutputPath: t.TempDir()})
+	if err := i.Start(); err != nil {
+		t.Fatal(err)
+	}
+	i.Stop()
+	i.Stop()
+}
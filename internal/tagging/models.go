@@ -0,0 +1,30 @@
+package tagging
+
+import "fmt"
+
+// DefaultModels is the model allowlist used when none is configured.  The first model is the default.
+var DefaultModels = []string{"SmilingWolf/wd-vit-large-tagger-v3"}
+
+type ModelNotAllowedError struct {
+	Model string
+}
+
+func (e ModelNotAllowedError) Error() string {
+	return fmt.Sprintf("model not allowed: %s", e.Model)
+}
+
+// ResolveModel checks the requested model against the allowlist.  An empty request resolves to the first model.
+func ResolveModel(allowed []string, requested string) (string, error) {
+	if len(allowed) == 0 {
+		return "", fmt.Errorf("no models configured")
+	}
+	if requested == "" {
+		return allowed[0], nil
+	}
+	for _, model := range allowed {
+		if model == requested {
+			return model, nil
+		}
+	}
+	return "", ModelNotAllowedError{Model: requested}
+}
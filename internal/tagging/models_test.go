@@ -0,0 +1,54 @@
+package tagging
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestResolveModel(t *testing.T) {
+	tests := map[string]struct {
+		allowed    []string
+		requested  string
+		want       string
+		notAllowed bool
+		wantErr    bool
+	}{
+		"default model": {
+			allowed:   []string{"a", "b"},
+			requested: "",
+			want:      "a",
+		},
+		"allowed model": {
+			allowed:   []string{"a", "b"},
+			requested: "b",
+			want:      "b",
+		},
+		"not allowed": {
+			allowed:    []string{"a", "b"},
+			requested:  "c",
+			notAllowed: true,
+			wantErr:    true,
+		},
+		"no models": {
+			allowed:   nil,
+			requested: "",
+			wantErr:   true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ResolveModel(test.allowed, test.requested)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, test.wantErr)
+			}
+			var notAllowed ModelNotAllowedError
+			if errors.As(err, &notAllowed) != test.notAllowed {
+				t.Errorf("got error %v, notAllowed %v", err, test.notAllowed)
+			}
+			if got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
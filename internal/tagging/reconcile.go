@@ -0,0 +1,262 @@
+package tagging
+
+import (
+	"errors"
+	"fmt"
+	"imagetag/internal/quarantine"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Policy says what to do with a job left over from a previous run.
+type Policy string
+
+// POLICY_ADOPT gives the job's result to the Adopter, so that it can still be fetched by its job id.
+const POLICY_ADOPT Policy = "adopt"
+
+// POLICY_ARCHIVE moves the job's file into quarantine.
+const POLICY_ARCHIVE Policy = "archive"
+
+// POLICY_DELETE deletes the job's file.
+const POLICY_DELETE Policy = "delete"
+
+func ParsePolicy(value string) (Policy, error) {
+	switch policy := Policy(value); policy {
+	case POLICY_ADOPT, POLICY_ARCHIVE, POLICY_DELETE:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown policy: %s", value)
+	}
+}
+
+// ReconcilePolicy says what to do with each kind of job left over from a previous run.
+type ReconcilePolicy struct {
+	// Input applies to job packages still waiting in the input folder.  Adopting them waits for their results.
+	Input Policy
+	// Output applies to result files waiting in the output folder.
+	Output Policy
+}
+
+// Adopter takes results for jobs submitted before a restart, which no request is waiting for.
+type Adopter interface {
+	// AdoptPending is told of a job still waiting in the input folder, whose result will be given to Adopt.
+	AdoptPending(id string, submittedAt time.Time)
+	Adopt(id string, result JobResult)
+}
+
+type ReconcileSummary struct {
+	InputAdopted   int
+	InputArchived  int
+	InputDeleted   int
+	StagingDeleted int
+	OutputAdopted  int
+	OutputArchived int
+	OutputDeleted  int
+	// OutputDiscarded counts misnamed or undecodable results, which are quarantined or deleted regardless of policy.
+	OutputDiscarded int
+	// Failed counts files which couldn't be moved or deleted.  They're left where they are.
+	Failed int
+}
+
+// Reconcile applies the policy to job packages and results left over from a previous run.  It must be called before
+// Start, otherwise Start would treat leftover results as new.  Partially written job packages are always deleted.
+func (i *InterrogateForever) Reconcile(policy ReconcilePolicy, adopter Adopter) (ReconcileSummary, error) {
+	summary := ReconcileSummary{}
+	for _, p := range []Policy{policy.Input, policy.Output} {
+		if p == POLICY_ADOPT && adopter == nil {
+			return summary, errors.New("adopt policy requires an adopter")
+		}
+		if p == POLICY_ARCHIVE && i.Quarantine == nil {
+			return summary, errors.New("archive policy requires a quarantine")
+		}
+	}
+	i.initJobs()
+	i.adopter = adopter
+
+	if err := i.reconcileInput(policy.Input, &summary); err != nil {
+		return summary, err
+	}
+	if err := i.reconcileOutput(policy.Output, &summary); err != nil {
+		return summary, err
+	}
+	slog.Info("reconciled leftover jobs",
+		"input_adopted", summary.InputAdopted,
+		"input_archived", summary.InputArchived,
+		"input_deleted", summary.InputDeleted,
+		"staging_deleted", summary.StagingDeleted,
+		"output_adopted", summary.OutputAdopted,
+		"output_archived", summary.OutputArchived,
+		"output_deleted", summary.OutputDeleted,
+		"output_discarded", summary.OutputDiscarded,
+		"failed", summary.Failed,
+	)
+	return summary, nil
+}
+
+func (i *InterrogateForever) reconcileInput(policy Policy, summary *ReconcileSummary) error {
+	entries, err := os.ReadDir(i.InputPath)
+	if err != nil {
+		return fmt.Errorf("could not read input folder: %s", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		filePath := filepath.Join(i.InputPath, entry.Name())
+		if strings.HasPrefix(entry.Name(), stagingPrefix) {
+			if err := os.Remove(filePath); err != nil {
+				i.reconcileFailed(summary, "delete staging file", filePath, err)
+				continue
+			}
+			summary.StagingDeleted++
+			continue
+		}
+		id, isPackage := strings.CutSuffix(entry.Name(), ".zip")
+		if !isPackage {
+			// not ours
+			continue
+		}
+		switch policy {
+		case POLICY_ADOPT:
+			submittedAt := time.Now()
+			if info, err := entry.Info(); err == nil {
+				submittedAt = info.ModTime()
+			}
+			i.jobMutex.Lock()
+			i.adopted[id] = submittedAt
+			i.jobMutex.Unlock()
+			i.adopter.AdoptPending(id, submittedAt)
+			summary.InputAdopted++
+		case POLICY_ARCHIVE:
+			if _, err := i.Quarantine.Move(filePath, quarantine.REASON_ORPHANED, "job package left in input folder"); err != nil {
+				i.reconcileFailed(summary, "archive job package", filePath, err)
+				continue
+			}
+			summary.InputArchived++
+		case POLICY_DELETE:
+			if err := os.Remove(filePath); err != nil {
+				i.reconcileFailed(summary, "delete job package", filePath, err)
+				continue
+			}
+			summary.InputDeleted++
+		}
+	}
+	return nil
+}
+
+func (i *InterrogateForever) reconcileOutput(policy Policy, summary *ReconcileSummary) error {
+	entries, err := os.ReadDir(i.OutputPath)
+	if err != nil {
+		return fmt.Errorf("could not read output folder: %s", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || isHandoffFile(entry.Name()) {
+			continue
+		}
+		filePath := filepath.Join(i.OutputPath, entry.Name())
+		id, ok := parseResultFilename(entry.Name())
+		if !ok {
+			i.discardResult(filePath, "", quarantine.REASON_MALFORMED_NAME, "expected <job id>.<ext>")
+			summary.OutputDiscarded++
+			continue
+		}
+		switch policy {
+		case POLICY_ADOPT:
+			resultFile, err := i.readResultFile(filePath)
+			if err != nil {
+				i.discardResult(filePath, id, quarantine.REASON_UNDECODABLE, err.Error())
+				summary.OutputDiscarded++
+				continue
+			}
+			completedAt := time.Now()
+			if info, err := entry.Info(); err == nil {
+				completedAt = info.ModTime()
+			}
+			result := JobResult{
+				JobId:       id,
+				Tags:        tagNames(resultFile.Tags),
+				TagDetails:  resultFile.Tags,
+				Model:       resultFile.Model,
+				SubmittedAt: completedAt,
+				CompletedAt: completedAt,
+			}
+			if resultFile.Error != "" {
+				result.Error = classifyBackendError(id, resultFile.Error)
+			}
+			i.adopter.Adopt(id, result)
+			if err := os.Remove(filePath); err != nil {
+				i.reconcileFailed(summary, "remove adopted result", filePath, err)
+				continue
+			}
+			summary.OutputAdopted++
+		case POLICY_ARCHIVE:
+			if _, err := i.Quarantine.Move(filePath, quarantine.REASON_ORPHANED, "result left in output folder"); err != nil {
+				i.reconcileFailed(summary, "archive result", filePath, err)
+				continue
+			}
+			summary.OutputArchived++
+		case POLICY_DELETE:
+			if err := os.Remove(filePath); err != nil {
+				i.reconcileFailed(summary, "delete result", filePath, err)
+				continue
+			}
+			summary.OutputDeleted++
+		}
+	}
+	return nil
+}
+
+// reconcileFailed logs a file which couldn't be reconciled and counts it, so that one bad file doesn't stop the rest.
+func (i *InterrogateForever) reconcileFailed(summary *ReconcileSummary, action string, filePath string, err error) {
+	slog.Warn("could not "+action, "file", filePath, "error", err)
+	summary.Failed++
+}
+
+// sendAdopted gives the response to the adopter if the job was adopted, reporting whether it was.
+func (i *InterrogateForever) sendAdopted(id string, response JobResult) bool {
+	i.jobMutex.Lock()
+	submittedAt, adopted := i.adopted[id]
+	delete(i.adopted, id)
+	i.jobMutex.Unlock()
+	if !adopted {
+		return false
+	}
+	response.JobId = id
+	response.SubmittedAt = submittedAt
+	response.CompletedAt = time.Now()
+	i.adopter.Adopt(id, response)
+	return true
+}
+
+// forgetAdopted stops waiting on adopted jobs submitted before the cutoff, failing them so that they don't stay pending.
+func (i *InterrogateForever) forgetAdopted(before time.Time) {
+	i.jobMutex.Lock()
+	forgotten := map[string]time.Time{}
+	for id, submittedAt := range i.adopted {
+		if submittedAt.Before(before) {
+			forgotten[id] = submittedAt
+			delete(i.adopted, id)
+		}
+	}
+	i.jobMutex.Unlock()
+	for id, submittedAt := range forgotten {
+		i.adopter.Adopt(id, JobResult{
+			JobId:       id,
+			SubmittedAt: submittedAt,
+			CompletedAt: time.Now(),
+			Error:       BackendError{Code: ERROR_BACKEND, Message: "no result arrived for the job left over from a previous run", JobId: id},
+		})
+	}
+}
+
+// parseResultFilename returns the job id from a result file named <job id>.<ext>.
+func parseResultFilename(filename string) (string, bool) {
+	parts := strings.Split(filename, ".")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
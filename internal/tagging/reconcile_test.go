@@ -0,0 +1,210 @@
+package tagging
+
+import (
+	"imagetag/internal/quarantine"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeAdopter struct {
+	results map[string]JobResult
+	pending []string
+	mutex   sync.Mutex
+}
+
+func (f *fakeAdopter) AdoptPending(id string, submittedAt time.Time) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.pending = append(f.pending, id)
+}
+
+func (f *fakeAdopter) Adopt(id string, result JobResult) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.results[id] = result
+}
+
+func (f *fakeAdopter) get(id string) (JobResult, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	result, ok := f.results[id]
+	return result, ok
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildLeftovers builds an InterrogateForever whose folders hold jobs left over from a previous run.
+func buildLeftovers(t *testing.T) *InterrogateForever {
+	t.Helper()
+	q, err := quarantine.BuildQuarantine(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := Build(Config{InputPath: t.TempDir(), OutputPath: t.TempDir(), Quarantine: q})
+	i.ResultSettleInterval = time.Millisecond
+	i.ResultMaxAttempts = 3
+	t.Cleanup(func() {
+		if i.watcher != nil {
+			i.Stop()
+		}
+	})
+	files := map[string]string{
+		filepath.Join(i.InputPath, "queued.zip"):                  "zip",
+		filepath.Join(i.InputPath, stagingPrefix+"partial-1.tmp"): "zi",
+		filepath.Join(i.InputPath, "notes.txt"):                   "not ours",
+		filepath.Join(i.OutputPath, "done.json"):                  `{"job_id": "done", "model": "model-a", "tags": ["cat"]}`,
+		filepath.Join(i.OutputPath, "broken.json"):                `{"job_id": `,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return i
+}
+
+func TestInterrogateForever_Reconcile(t *testing.T) {
+	tests := map[string]struct {
+		policy          ReconcilePolicy
+		wantSummary     ReconcileSummary
+		wantInput       []string
+		wantOutput      []string
+		wantQuarantined int
+		wantAdopted     []string
+	}{
+		"adopt": {
+			policy:          ReconcilePolicy{Input: POLICY_ADOPT, Output: POLICY_ADOPT},
+			wantSummary:     ReconcileSummary{InputAdopted: 1, StagingDeleted: 1, OutputAdopted: 1, OutputDiscarded: 1},
+			wantInput:       []string{"notes.txt", "queued.zip"},
+			wantOutput:      []string{},
+			wantQuarantined: 1,
+			wantAdopted:     []string{"done"},
+		},
+		"archive": {
+			policy:          ReconcilePolicy{Input: POLICY_ARCHIVE, Output: POLICY_ARCHIVE},
+			wantSummary:     ReconcileSummary{InputArchived: 1, StagingDeleted: 1, OutputArchived: 2},
+			wantInput:       []string{"notes.txt"},
+			wantOutput:      []string{},
+			wantQuarantined: 3,
+		},
+		"delete": {
+			policy:          ReconcilePolicy{Input: POLICY_DELETE, Output: POLICY_DELETE},
+			wantSummary:     ReconcileSummary{InputDeleted: 1, StagingDeleted: 1, OutputDeleted: 2},
+			wantInput:       []string{"notes.txt"},
+			wantOutput:      []string{},
+			wantQuarantined: 0,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i := buildLeftovers(t)
+			adopter := &fakeAdopter{results: map[string]JobResult{}}
+
+			summary, err := i.Reconcile(test.policy, adopter)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if summary != test.wantSummary {
+				t.Errorf("got summary %+v, want %+v", summary, test.wantSummary)
+			}
+			if got := listFiles(t, i.InputPath); !slices.Equal(got, test.wantInput) {
+				t.Errorf("got input files %v, want %v", got, test.wantInput)
+			}
+			if got := listFiles(t, i.OutputPath); !slices.Equal(got, test.wantOutput) {
+				t.Errorf("got output files %v, want %v", got, test.wantOutput)
+			}
+			entries, err := i.Quarantine.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != test.wantQuarantined {
+				t.Errorf("got %d quarantined, want %d", len(entries), test.wantQuarantined)
+			}
+			for _, id := range test.wantAdopted {
+				if result, ok := adopter.get(id); !ok || len(result.Tags) == 0 {
+					t.Errorf("expected %s to be adopted with tags, got %+v", id, result)
+				}
+			}
+		})
+	}
+}
+
+func TestInterrogateForever_Reconcile_AdoptQueued(t *testing.T) {
+	i := buildLeftovers(t)
+	adopter := &fakeAdopter{results: map[string]JobResult{}}
+	if _, err := i.Reconcile(ReconcilePolicy{Input: POLICY_ADOPT, Output: POLICY_DELETE}, adopter); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(adopter.pending, []string{"queued"}) {
+		t.Errorf("got pending %v, want [queued]", adopter.pending)
+	}
+	if err := i.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte(`{"job_id": "queued", "model": "model-a", "tags": ["dog"]}`)
+	if err := os.WriteFile(filepath.Join(i.OutputPath, "queued.json"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if result, ok := adopter.get("queued"); ok {
+			if result.JobId != "queued" || len(result.Tags) != 1 || result.Tags[0] != "dog" {
+				t.Errorf("got adopted result %+v", result)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for the queued job to be adopted")
+}
+
+func TestInterrogateForever_Reconcile_ContinuesPastFailures(t *testing.T) {
+	i := buildLeftovers(t)
+	// nothing can be archived once the quarantine folder is gone
+	if err := os.RemoveAll(i.Quarantine.Path); err != nil {
+		t.Fatal(err)
+	}
+
+	summary, err := i.Reconcile(ReconcilePolicy{Input: POLICY_ARCHIVE, Output: POLICY_ARCHIVE}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ReconcileSummary{StagingDeleted: 1, Failed: 3}); summary != want {
+		t.Errorf("got summary %+v, want %+v", summary, want)
+	}
+	if got := listFiles(t, i.InputPath); !slices.Equal(got, []string{"notes.txt", "queued.zip"}) {
+		t.Errorf("got input %v", got)
+	}
+}
+
+func TestInterrogateForever_Reconcile_InvalidPolicy(t *testing.T) {
+	i := Build(Config{InputPath: t.TempDir(), OutputPath: t.TempDir()})
+
+	if _, err := i.Reconcile(ReconcilePolicy{Input: POLICY_ADOPT, Output: POLICY_DELETE}, nil); err == nil {
+		t.Error("expected error adopting without an adopter")
+	}
+	if _, err := i.Reconcile(ReconcilePolicy{Input: POLICY_DELETE, Output: POLICY_ARCHIVE}, nil); err == nil {
+		t.Error("expected error archiving without a quarantine")
+	}
+}
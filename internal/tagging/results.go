@@ -0,0 +1,62 @@
+package tagging
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// isHandoffFile reports whether the file is a temporary file which a writer will rename into place once complete.
+func isHandoffFile(filename string) bool {
+	return strings.HasPrefix(filename, ".") || strings.HasSuffix(filename, ".tmp") || strings.HasSuffix(filename, ".part")
+}
+
+// readResultFile waits for the result file to be completely written and then decodes it.  The file is complete once
+// its size is unchanged between two checks and it holds a valid JSON document.  It gives up after ResultMaxAttempts
+// checks, returning the last problem found.
+func (i *InterrogateForever) readResultFile(filePath string) (ResultFile, error) {
+	var lastSize int64 = -1
+	lastErr := errors.New("result file was never complete")
+	for attempt := 0; attempt < i.ResultMaxAttempts; attempt++ {
+		time.Sleep(i.ResultSettleInterval)
+
+		info, err := os.Stat(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return ResultFile{}, err
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("could not stat file: %s", err)
+			continue
+		}
+		size := info.Size()
+		if size == 0 || size != lastSize {
+			lastSize = size
+			lastErr = errors.New("result file still being written")
+			continue
+		}
+
+		content, err := os.ReadFile(filePath)
+		if errors.Is(err, os.ErrNotExist) {
+			return ResultFile{}, err
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("could not read file: %s", err)
+			continue
+		}
+		if int64(len(content)) != size {
+			lastSize = int64(len(content))
+			lastErr = errors.New("result file still being written")
+			continue
+		}
+		var resultFile ResultFile
+		if err := json.Unmarshal(content, &resultFile); err != nil {
+			lastErr = fmt.Errorf("could not decode file: %s", err)
+			continue
+		}
+		return resultFile, nil
+	}
+	return ResultFile{}, lastErr
+}
@@ -0,0 +1,214 @@
+package tagging
+
+import (
+	"errors"
+	"imagetag/internal/quarantine"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// submitTestJob submits an image and returns the result channel and the id interrogate_forever will see.
+func submitTestJob(t *testing.T, i *InterrogateForever) (<-chan JobResult, string) {
+	t.Helper()
+	i.ResultSettleInterval = 10 * time.Millisecond
+	i.ResultMaxAttempts = 10
+	submission, err := i.TagImage(openTestImage(t, testPng), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(submission.Cancel)
+	if spec := waitForJob(t, i.InputPath); spec.JobId != submission.JobId {
+		t.Fatalf("got job id %s in job spec, want %s", spec.JobId, submission.JobId)
+	}
+	return submission.Results, submission.JobId
+}
+
+func TestInterrogateForever_HandleResponse(t *testing.T) {
+	tests := map[string]struct {
+		write    func(t *testing.T, outputPath string, id string)
+		wantErr  bool
+		wantCode ErrorCode
+	}{
+		"slow writer": {
+			write: func(t *testing.T, outputPath string, id string) {
+				content := []byte(`{"job_id": "` + id + `", "model": "model-a", "tags": ["cat", "outdoors"]}`)
+				f, err := os.Create(filepath.Join(outputPath, id+".json"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+				f.Write(content[:10])
+				time.Sleep(30 * time.Millisecond)
+				f.Write(content[10:])
+			},
+			wantErr: false,
+		},
+		"rename handoff": {
+			write: func(t *testing.T, outputPath string, id string) {
+				content := []byte(`{"job_id": "` + id + `", "model": "model-a", "tags": ["cat"]}`)
+				tmpPath := filepath.Join(outputPath, id+".json.tmp")
+				if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(30 * time.Millisecond)
+				if err := os.Rename(tmpPath, filepath.Join(outputPath, id+".json")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: false,
+		},
+		"backend error": {
+			write: func(t *testing.T, outputPath string, id string) {
+				content := []byte(`{"job_id": "` + id + `", "model": "model-a", "tags": [], "error": "cannot identify image file"}`)
+				if err := os.WriteFile(filepath.Join(outputPath, id+".json"), content, 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr:  true,
+			wantCode: ERROR_INVALID_IMAGE,
+		},
+		"malformed": {
+			write: func(t *testing.T, outputPath string, id string) {
+				if err := os.WriteFile(filepath.Join(outputPath, id+".json"), []byte(`{"job_id": `), 0644); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr:  true,
+			wantCode: ERROR_INVALID_RESULT,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i := buildTestInterrogator(t)
+			c, id := submitTestJob(t, i)
+
+			test.write(t, i.OutputPath, id)
+
+			select {
+			case result := <-c:
+				if (result.Error != nil) != test.wantErr {
+					t.Errorf("got error %v, wantErr %v", result.Error, test.wantErr)
+				}
+				if !test.wantErr && len(result.Tags) == 0 {
+					t.Error("expected tags")
+				}
+				var backendErr BackendError
+				if test.wantErr && (!errors.As(result.Error, &backendErr) || backendErr.Code != test.wantCode || backendErr.JobId != id) {
+					t.Errorf("got error %v, want BackendError with code %s", result.Error, test.wantCode)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for result")
+			}
+
+			select {
+			case result := <-c:
+				t.Errorf("got a second result: %+v", result)
+			case <-time.After(100 * time.Millisecond):
+			}
+		})
+	}
+}
+
+// waitForQuarantine waits for a file to be quarantined and returns its entry.
+func waitForQuarantine(t *testing.T, q *quarantine.Quarantine) quarantine.Entry {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		entries, err := q.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) > 0 {
+			return entries[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("timed out waiting for quarantine")
+	return quarantine.Entry{}
+}
+
+func TestInterrogateForever_HandleResponse_Quarantine(t *testing.T) {
+	tests := map[string]struct {
+		filename   string
+		content    string
+		wantReason quarantine.Reason
+	}{
+		"malformed name": {
+			filename:   "abc.def.json",
+			content:    `{"job_id": "abc"}`,
+			wantReason: quarantine.REASON_MALFORMED_NAME,
+		},
+		"undecodable": {
+			filename:   "abc.json",
+			content:    `{"job_id": `,
+			wantReason: quarantine.REASON_UNDECODABLE,
+		},
+		"unmatched": {
+			filename:   "abc.json",
+			content:    `{"job_id": "abc", "tags": ["cat"]}`,
+			wantReason: quarantine.REASON_UNMATCHED,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			i := buildTestInterrogator(t)
+			i.ResultSettleInterval = 10 * time.Millisecond
+			i.ResultMaxAttempts = 10
+
+			if err := os.WriteFile(filepath.Join(i.OutputPath, test.filename), []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			entry := waitForQuarantine(t, i.Quarantine)
+			if entry.Reason != test.wantReason {
+				t.Errorf("got reason %s, want %s", entry.Reason, test.wantReason)
+			}
+			if _, err := os.Stat(filepath.Join(i.OutputPath, test.filename)); !os.IsNotExist(err) {
+				t.Errorf("expected result file to be moved out of the output folder, got %v", err)
+			}
+		})
+	}
+}
+
+func TestInterrogateForever_HandleResponse_Cancelled(t *testing.T) {
+	i := buildTestInterrogator(t)
+	i.ResultSettleInterval = 10 * time.Millisecond
+	submission, err := i.TagImage(openTestImage(t, testPng), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := waitForJob(t, i.InputPath).JobId
+	submission.Cancel()
+
+	resultPath := filepath.Join(i.OutputPath, id+".json")
+	if err := os.WriteFile(resultPath, []byte(`{"job_id": "`+id+`", "tags": ["cat"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(resultPath); os.IsNotExist(err) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := os.Stat(resultPath); !os.IsNotExist(err) {
+		t.Fatalf("expected result file to be removed, got %v", err)
+	}
+	entries, err := i.Quarantine.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected nothing quarantined, got %+v", entries)
+	}
+	select {
+	case result := <-submission.Results:
+		t.Errorf("got result for cancelled job: %+v", result)
+	default:
+	}
+}
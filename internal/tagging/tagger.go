@@ -0,0 +1,41 @@
+package tagging
+
+import "mime/multipart"
+
+// Tagger is a backend which produces tags for an image.  InterrogateForever is the production implementation, other
+// backends and in-memory fakes may be swapped in behind the web layer.
+type Tagger interface {
+	// TagImage submits the image to be tagged by the model, or the default model if empty.  The image has been fully
+	// read by the time TagImage returns.  A ModelNotAllowedError is returned if the model isn't in AllowedModels.
+	TagImage(imageFile multipart.File, model string) (Submission, error)
+	// Validate checks the image and model as TagImage does, without submitting anything, so that they can be refused
+	// before waiting for a turn with the backend.  The image is left rewound.
+	Validate(imageFile multipart.File, model string) error
+	// AllowedModels lists the models which may be requested.  The first is the default.
+	AllowedModels() []string
+}
+
+// IdentifiedTagger is a Tagger which can give a job an id chosen by the caller, so that the id can be handed out before
+// the job is submitted and still identifies its result after a restart.
+type IdentifiedTagger interface {
+	Tagger
+	// TagImageAs is TagImage with the job given the id, which must be unique.
+	TagImageAs(id string, imageFile multipart.File, model string) (Submission, error)
+}
+
+// Submission is a job which has been submitted to a Tagger.
+type Submission struct {
+	// JobId identifies the job.  It's the same id the JobResult carries.
+	JobId string
+	// Results receives the JobResult once the job is finished.
+	Results <-chan JobResult
+	// Cancel abandons the job if the caller stops waiting.
+	Cancel func()
+}
+
+// HashedFile is an image file whose SHA-256 was computed as it was received, so that it needn't be read again to hash
+// it.
+type HashedFile interface {
+	multipart.File
+	Sha256() []byte
+}
@@ -0,0 +1,43 @@
+package tagging
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+const CATEGORY_GENERAL = "general"
+const CATEGORY_CHARACTER = "character"
+const CATEGORY_RATING = "rating"
+
+// Tag is a single tag produced by the model.  Score and Category are only known when interrogate_forever writes
+// scored tags.
+type Tag struct {
+	Name     string   `json:"name"`
+	Score    *float64 `json:"score,omitempty"`
+	Category string   `json:"category,omitempty"`
+}
+
+// UnmarshalJSON accepts either a plain tag name or an object with name, score and category, so that result files
+// from both older and newer versions of interrogate_forever can be read.
+func (t *Tag) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte(`"`)) {
+		*t = Tag{}
+		return json.Unmarshal(data, &t.Name)
+	}
+	// alias drops the UnmarshalJSON method, avoiding recursion
+	type alias Tag
+	var a alias
+	if err := json.Unmarshal(data, &a); err != nil {
+		return err
+	}
+	*t = Tag(a)
+	return nil
+}
+
+func tagNames(tags []Tag) []string {
+	names := make([]string, len(tags))
+	for i, tag := range tags {
+		names[i] = tag.Name
+	}
+	return names
+}
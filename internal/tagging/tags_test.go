@@ -0,0 +1,46 @@
+package tagging
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestResultFile_DecodeTags(t *testing.T) {
+	score := 0.75
+	tests := map[string]struct {
+		content string
+		want    []Tag
+		wantErr bool
+	}{
+		"plain names": {
+			content: `{"job_id": "1", "tags": ["cat", "outdoors"]}`,
+			want:    []Tag{{Name: "cat"}, {Name: "outdoors"}},
+		},
+		"scored tags": {
+			content: `{"job_id": "1", "tags": [{"name": "cat", "score": 0.75, "category": "general"}]}`,
+			want:    []Tag{{Name: "cat", Score: &score, Category: CATEGORY_GENERAL}},
+		},
+		"mixed": {
+			content: `{"job_id": "1", "tags": ["cat", {"name": "general", "score": 0.75, "category": "rating"}]}`,
+			want:    []Tag{{Name: "cat"}, {Name: "general", Score: &score, Category: CATEGORY_RATING}},
+		},
+		"invalid tag": {
+			content: `{"job_id": "1", "tags": [12]}`,
+			wantErr: true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var resultFile ResultFile
+			err := json.Unmarshal([]byte(test.content), &resultFile)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(resultFile.Tags, test.want) {
+				t.Errorf("got %+v, want %+v", resultFile.Tags, test.want)
+			}
+		})
+	}
+}
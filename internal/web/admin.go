@@ -0,0 +1,26 @@
+package web
+
+import (
+	"crypto/subtle"
+	"net/http"
+)
+
+// requireAdminKey builds middleware which only lets through requests presenting the admin key in an `X-Admin-Key`
+// header.  Every request is refused with 403 when no admin key is configured.
+func requireAdminKey(adminKey string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fh := func(w http.ResponseWriter, r *http.Request) {
+			if adminKey == "" {
+				writeJsonError(w, requestError{Status: http.StatusForbidden, Code: "admin_disabled", Message: "No admin key is configured"})
+				return
+			}
+			key := r.Header.Get("X-Admin-Key")
+			if subtle.ConstantTimeCompare([]byte(key), []byte(adminKey)) != 1 {
+				writeJsonError(w, requestError{Status: http.StatusUnauthorized, Code: "unauthorized", Message: "The admin key is missing or wrong"})
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fh)
+	}
+}
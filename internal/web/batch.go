@@ -0,0 +1,183 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"imagetag/internal/tagging"
+	"imagetag/keythrottle"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// DefaultMaxBatchItems is how many images one batch may hold.
+const DefaultMaxBatchItems = 100
+
+// batchLine is one line of the NDJSON response to a batch, written as each image's job finishes.
+type batchLine struct {
+	Filename string         `json:"filename"`
+	JobId    string         `json:"job_id,omitempty"`
+	Model    string         `json:"model,omitempty"`
+	Tags     []string       `json:"tags"`
+	Error    *errorResponse `json:"error,omitempty"`
+}
+
+func failedLine(filename string, err error) batchLine {
+	_, body := describeError(err)
+	return batchLine{Filename: filename, Tags: []string{}, Error: &body}
+}
+
+// batchItem is an image from the batch which was submitted.
+type batchItem struct {
+	filename   string
+	submission tagging.Submission
+	// done tells the scheduler the job is finished
+	done func()
+}
+
+// tagBatch tags every image in a multipart request, streaming an NDJSON line for each as its job finishes.  Images
+// which fail don't abort the rest.  The whole request is received, and every image submitted, before the first line
+// is written.  The model comes from the model query parameter or a model field sent before the images.  Each image
+// waits its turn with the scheduler before it's submitted, once it's been validated.
+func tagBatch(w http.ResponseWriter, r *http.Request, tagger tagging.Tagger, scheduler *keythrottle.Scheduler, spoolDir string, maxUploadSize int64, maxItems int) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		writeJsonError(w, requestError{Status: http.StatusBadRequest, Code: "malformed_upload", Message: "Expected a multipart/form-data upload"})
+		return
+	}
+	// multipart framing and other fields are allowed a little over the images' limit
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize*int64(maxItems)+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		writeJsonError(w, requestError{Status: http.StatusBadRequest, Code: "malformed_upload", Message: "Malformed multipart/form-data upload"})
+		return
+	}
+
+	// ctx ends when the client disconnects or the handler returns early, cancelling the jobs which are still running
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	model := r.URL.Query().Get("model")
+	submitted := 0
+	var failed []batchLine
+	// lines receives each submitted image's line.  Results are collected as soon as the image is submitted, so that
+	// the scheduler's capacity is given back while the rest of the batch is still being received.
+	lines := make(chan batchLine, maxItems)
+	collect := func(item batchItem) {
+		defer item.done()
+		select {
+		case result := <-item.submission.Results:
+			lines <- resultLine(item.filename, result)
+		case <-ctx.Done():
+			item.submission.Cancel()
+		}
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if r.Context().Err() != nil {
+				return
+			}
+			// the rest of the batch can't be read, but the images already received are still tagged
+			failed = append(failed, failedLine("", tooLargeOr(err, maxUploadSize*int64(maxItems))))
+			break
+		}
+		if part.FormName() == "model" {
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err == nil {
+				model = strings.TrimSpace(string(value))
+			}
+			part.Close()
+			continue
+		}
+		if part.FileName() == "" {
+			part.Close()
+			continue
+		}
+		filename := part.FileName()
+		if submitted+len(failed) >= maxItems {
+			failed = append(failed, failedLine(filename, requestError{
+				Status:  http.StatusRequestEntityTooLarge,
+				Code:    "batch_too_large",
+				Message: fmt.Sprintf("A batch may hold at most %d images", maxItems),
+			}))
+			part.Close()
+			continue
+		}
+		file, err := spool(part, spoolDir, maxUploadSize)
+		part.Close()
+		if err != nil {
+			failed = append(failed, failedLine(filename, tooLargeOr(err, maxUploadSize)))
+			continue
+		}
+		if err := tagger.Validate(file, model); err != nil {
+			file.Close()
+			failed = append(failed, failedLine(filename, err))
+			continue
+		}
+		done, err := schedule(r, scheduler)
+		if err != nil {
+			file.Close()
+			return
+		}
+		submission, err := tagger.TagImage(file, model)
+		file.Close()
+		if err != nil {
+			done()
+			failed = append(failed, failedLine(filename, err))
+			continue
+		}
+		submitted++
+		go collect(batchItem{filename: filename, submission: submission, done: done})
+	}
+	if submitted == 0 && len(failed) == 0 {
+		writeJsonError(w, requestError{Status: http.StatusNotFound, Code: "file_not_found", Message: "No images in the batch"})
+		return
+	}
+	log.Printf("received batch of %d images, %d failed", submitted+len(failed), len(failed))
+
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+	flusher := http.NewResponseController(w)
+	writeLine := func(line batchLine) {
+		if err := encoder.Encode(line); err != nil {
+			log.Printf("could not write batch line: %s", err)
+		}
+		flusher.Flush()
+	}
+	for _, line := range failed {
+		writeLine(line)
+	}
+
+	for i := 0; i < submitted; i++ {
+		select {
+		case line := <-lines:
+			writeLine(line)
+		case <-r.Context().Done():
+			log.Println("client disconnected, cancelling the rest of the batch")
+			return
+		}
+	}
+}
+
+func resultLine(filename string, result tagging.JobResult) batchLine {
+	if result.Error != nil {
+		line := failedLine(filename, result.Error)
+		line.JobId = result.JobId
+		line.Model = result.Model
+		return line
+	}
+	tags := result.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return batchLine{Filename: filename, JobId: result.JobId, Model: result.Model, Tags: tags}
+}
@@ -0,0 +1,181 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"imagetag/internal/jobs"
+	"imagetag/internal/tagging"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// batchTagger tags each image with its size, and never finishes images larger than slowSize.
+type batchTagger struct {
+	slowSize  int
+	mutex     sync.Mutex
+	submitted int
+	cancelled int
+}
+
+func (b *batchTagger) TagImage(imageFile multipart.File, model string) (tagging.Submission, error) {
+	content, err := io.ReadAll(imageFile)
+	if err != nil {
+		return tagging.Submission{}, err
+	}
+	b.mutex.Lock()
+	b.submitted++
+	b.mutex.Unlock()
+	results := make(chan tagging.JobResult, 1)
+	if b.slowSize == 0 || len(content) <= b.slowSize {
+		results <- tagging.JobResult{JobId: "job", Model: model, Tags: []string{"cat"}}
+	}
+	return tagging.Submission{JobId: "job", Results: results, Cancel: func() {
+		b.mutex.Lock()
+		b.cancelled++
+		b.mutex.Unlock()
+	}}, nil
+}
+
+func (b *batchTagger) Validate(imageFile multipart.File, model string) error {
+	return nil
+}
+
+func (b *batchTagger) AllowedModels() []string {
+	return []string{"model-a"}
+}
+
+func buildBatchRequest(t *testing.T, files map[string][]byte) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("model", "model-b")
+	for name, content := range files {
+		part, err := mw.CreateFormFile("images", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(content)
+	}
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-batch", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func readBatchLines(t *testing.T, body io.Reader) map[string]batchLine {
+	t.Helper()
+	lines := map[string]batchLine{}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		var line batchLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("could not decode line %s: %v", scanner.Text(), err)
+		}
+		lines[line.Filename] = line
+	}
+	return lines
+}
+
+func TestBuildRouter_TagBatch(t *testing.T) {
+	tagger := &batchTagger{}
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute), MaxBatchItems: 3})
+	req := buildBatchRequest(t, map[string][]byte{
+		"cat.png":   pngHeader,
+		"dog.png":   pngHeader,
+		"notes.txt": []byte("plain text"),
+	})
+	w := httptest.NewRecorder()
+
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if got := w.Header().Get("Content-Type"); got != "application/x-ndjson" {
+		t.Errorf("got content type %s", got)
+	}
+	lines := readBatchLines(t, w.Body)
+	if len(lines) != 3 {
+		t.Fatalf("got %d lines, want 3: %v", len(lines), lines)
+	}
+	for _, name := range []string{"cat.png", "dog.png"} {
+		line := lines[name]
+		if line.Error != nil || len(line.Tags) != 1 || line.Model != "model-b" {
+			t.Errorf("got %+v for %s, want tags from model-b", line, name)
+		}
+	}
+	if failed := lines["notes.txt"]; failed.Error == nil || failed.Error.Code != "unsupported_format" {
+		t.Errorf("got %+v for notes.txt, want an unsupported_format error", failed)
+	}
+}
+
+func TestBuildRouter_TagBatch_TooMany(t *testing.T) {
+	tagger := &batchTagger{}
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute), MaxBatchItems: 1})
+	w := httptest.NewRecorder()
+
+	r.ServeHTTP(w, buildBatchRequest(t, map[string][]byte{"cat.png": pngHeader, "dog.png": pngHeader}))
+
+	lines := readBatchLines(t, w.Body)
+	tooMany := 0
+	for _, line := range lines {
+		if line.Error != nil && line.Error.Code == "batch_too_large" {
+			tooMany++
+		}
+	}
+	if tooMany != 1 || tagger.submitted != 1 {
+		t.Errorf("got %d refused and %d submitted, want 1 of each: %v", tooMany, tagger.submitted, lines)
+	}
+}
+
+func TestBuildRouter_TagBatch_Disconnect(t *testing.T) {
+	tagger := &batchTagger{slowSize: len(pngHeader)}
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute)})
+	slow := append(bytes.Clone(pngHeader), 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := buildBatchRequest(t, map[string][]byte{"fast.png": pngHeader, "slow-1.png": slow, "slow-2.png": slow}).WithContext(ctx)
+	w := httptest.NewRecorder()
+
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(w, req)
+		close(done)
+	}()
+	deadline := time.Now().Add(time.Second)
+	for {
+		tagger.mutex.Lock()
+		submitted := tagger.submitted
+		tagger.mutex.Unlock()
+		if submitted == 3 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("batch didn't stop after the client disconnected")
+	}
+
+	deadline = time.Now().Add(time.Second)
+	for {
+		tagger.mutex.Lock()
+		cancelled := tagger.cancelled
+		tagger.mutex.Unlock()
+		if cancelled == 2 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d jobs cancelled, want the 2 unfinished jobs", cancelled)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,99 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"imagetag/internal/fetch"
+	"imagetag/internal/imaging"
+	"imagetag/internal/tagging"
+	"log"
+	"net/http"
+)
+
+// errorResponse is the JSON body describing a failed request.
+type errorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	JobId   string `json:"job_id,omitempty"`
+}
+
+// requestError is a problem with the client's request.
+type requestError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e requestError) Error() string {
+	return e.Message
+}
+
+// describeError maps an error to the status code and body which describe it to the client.
+func describeError(err error) (int, errorResponse) {
+	var reqErr requestError
+	var backendErr tagging.BackendError
+	var notAllowed tagging.ModelNotAllowedError
+	var unsupported imaging.UnsupportedFormatError
+	var invalid imaging.InvalidImageError
+	var tooLarge imaging.ImageTooLargeError
+	var fetchErr fetch.FetchError
+	switch {
+	case errors.As(err, &reqErr):
+		return reqErr.Status, errorResponse{Code: reqErr.Code, Message: reqErr.Message}
+	case errors.As(err, &backendErr):
+		status := http.StatusBadGateway
+		if backendErr.Code == tagging.ERROR_INVALID_IMAGE {
+			status = http.StatusUnprocessableEntity
+		}
+		return status, errorResponse{Code: string(backendErr.Code), Message: backendErr.Message, JobId: backendErr.JobId}
+	case errors.As(err, &notAllowed):
+		return http.StatusBadRequest, errorResponse{Code: "model_not_allowed", Message: notAllowed.Error()}
+	case errors.As(err, &unsupported):
+		return http.StatusUnsupportedMediaType, errorResponse{Code: "unsupported_format", Message: unsupported.Error()}
+	case errors.As(err, &invalid):
+		return http.StatusUnprocessableEntity, errorResponse{Code: "invalid_image", Message: invalid.Error()}
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, errorResponse{Code: "image_too_large", Message: tooLarge.Error()}
+	case errors.As(err, &fetchErr):
+		return fetchStatus(fetchErr.Code), errorResponse{Code: string(fetchErr.Code), Message: fetchErr.Message}
+	case errors.Is(err, context.Canceled):
+		return http.StatusRequestTimeout, errorResponse{Code: "client_disconnected", Message: "Client disconnected"}
+	default:
+		log.Printf("internal error: %v", err)
+		return http.StatusInternalServerError, errorResponse{Code: "internal_error", Message: "Internal server error"}
+	}
+}
+
+func fetchStatus(code fetch.ErrorCode) int {
+	switch code {
+	case fetch.ERROR_URL_NOT_ALLOWED:
+		return http.StatusBadRequest
+	case fetch.ERROR_TIMEOUT:
+		return http.StatusGatewayTimeout
+	case fetch.ERROR_TOO_LARGE:
+		return http.StatusRequestEntityTooLarge
+	case fetch.ERROR_NOT_AN_IMAGE:
+		return http.StatusUnsupportedMediaType
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, err error) {
+	status, body := describeError(err)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError writes the error as JSON if the client accepts it, otherwise as plain text.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	if acceptsJson(r.Header.Get("Accept")) {
+		writeJsonError(w, err)
+		return
+	}
+	status, body := describeError(err)
+	http.Error(w, body.Message, status)
+}
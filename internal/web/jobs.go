@@ -0,0 +1,44 @@
+package web
+
+import (
+	"encoding/json"
+	"imagetag/internal/jobs"
+	"net/http"
+	"time"
+)
+
+type jobResponse struct {
+	JobId       string         `json:"job_id"`
+	Status      jobs.Status    `json:"status"`
+	SubmittedAt time.Time      `json:"submitted_at"`
+	FinishedAt  *time.Time     `json:"finished_at,omitempty"`
+	Result      *tagResponseV2 `json:"result,omitempty"`
+	Error       *errorResponse `json:"error,omitempty"`
+}
+
+func buildJobResponse(job jobs.Job) jobResponse {
+	response := jobResponse{
+		JobId:       job.Id,
+		Status:      job.Status,
+		SubmittedAt: job.SubmittedAt,
+	}
+	if !job.FinishedAt.IsZero() {
+		response.FinishedAt = &job.FinishedAt
+	}
+	switch job.Status {
+	case jobs.STATUS_COMPLETE:
+		result := buildTagResponseV2(job.Result)
+		response.Result = &result
+	case jobs.STATUS_FAILED:
+		_, body := describeError(job.Result.Error)
+		response.Error = &body
+	}
+	return response
+}
+
+func writeJob(w http.ResponseWriter, status int, job jobs.Job) {
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(buildJobResponse(job))
+}
@@ -0,0 +1,232 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"imagetag/internal/imaging"
+	"imagetag/internal/tagging"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// DefaultMaxUploadSize is the largest image upload accepted, in bytes.
+const DefaultMaxUploadSize = 50 << 20
+
+// maxFieldSize bounds the form fields sent alongside the image, such as the model.
+const maxFieldSize = 1 << 10
+
+// spoolPattern names upload spool files.  They're named like the tagger's staging files, so that any left behind in the
+// input folder by a crash are deleted when it's reconciled.
+const spoolPattern = ".staging-upload-*"
+
+// sniffSize is how much of an upload is read to detect its format before the rest is received.
+const sniffSize = 512
+
+var _ tagging.HashedFile = (*upload)(nil)
+
+// upload is an uploaded image spooled to a temporary file as it was received.  Closing it removes the file.
+type upload struct {
+	*os.File
+	sum []byte
+}
+
+func (u *upload) Sha256() []byte {
+	return u.sum
+}
+
+func (u *upload) Close() error {
+	err := u.File.Close()
+	if removeErr := os.Remove(u.Name()); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+		log.Printf("could not remove upload %s: %s", u.Name(), removeErr)
+	}
+	return err
+}
+
+// uploadTooLarge is the error for uploads over the size limit.
+func uploadTooLarge(maxSize int64) requestError {
+	return requestError{
+		Status:  http.StatusRequestEntityTooLarge,
+		Code:    "upload_too_large",
+		Message: fmt.Sprintf("Upload is larger than the limit of %d bytes", maxSize),
+	}
+}
+
+// receiveUpload receives the image from the request body, which may be a multipart form with an image field, the raw
+// image with an image/* content type, or JSON holding the image in base64.  The image is written to a temporary file
+// and hashed as it's received, and its format is sniffed from its first bytes so that anything other than a
+// supported image is refused before the rest is received.  The model comes from the body or the model query
+// parameter.
+func receiveUpload(w http.ResponseWriter, r *http.Request, spoolDir string, maxSize int64) (*upload, string, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", requestError{Status: http.StatusBadRequest, Code: "malformed_upload", Message: "Missing or invalid Content-Type"}
+	}
+	switch {
+	case mediaType == "multipart/form-data":
+		return receiveMultipart(w, r, spoolDir, maxSize)
+	case strings.HasPrefix(mediaType, "image/"):
+		return receiveRaw(w, r, spoolDir, maxSize)
+	case mediaType == "application/json":
+		return receiveBase64(w, r, spoolDir, maxSize)
+	default:
+		return nil, "", requestError{
+			Status:  http.StatusUnsupportedMediaType,
+			Code:    "unsupported_media_type",
+			Message: "Expected multipart/form-data, image/* or application/json",
+		}
+	}
+}
+
+// receiveRaw receives a request body which is the image itself.
+func receiveRaw(w http.ResponseWriter, r *http.Request, spoolDir string, maxSize int64) (*upload, string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
+	received, err := spool(r.Body, spoolDir, maxSize)
+	if err != nil {
+		return nil, "", tooLargeOr(err, maxSize)
+	}
+	return received, r.URL.Query().Get("model"), nil
+}
+
+// base64Upload is a JSON request body holding the image.
+type base64Upload struct {
+	ImageBase64 string `json:"image_base64"`
+	Model       string `json:"model"`
+}
+
+// receiveBase64 receives a JSON body holding the base64 encoded image.  Unlike the other modes the body is held in
+// memory while it's decoded.
+func receiveBase64(w http.ResponseWriter, r *http.Request, spoolDir string, maxSize int64) (*upload, string, error) {
+	// base64 is a third larger than the image it encodes
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize/3*4+1<<10)
+	var body base64Upload
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return nil, "", uploadTooLarge(maxSize)
+		}
+		return nil, "", requestError{Status: http.StatusBadRequest, Code: "malformed_upload", Message: "Malformed JSON body"}
+	}
+	if body.ImageBase64 == "" {
+		return nil, "", requestError{Status: http.StatusNotFound, Code: "file_not_found", Message: "image_base64 is missing"}
+	}
+	received, err := spool(base64.NewDecoder(base64.StdEncoding, strings.NewReader(body.ImageBase64)), spoolDir, maxSize)
+	if err != nil {
+		var corrupt base64.CorruptInputError
+		if errors.As(err, &corrupt) {
+			return nil, "", requestError{Status: http.StatusBadRequest, Code: "malformed_upload", Message: "image_base64 is not valid base64"}
+		}
+		return nil, "", err
+	}
+	model := body.Model
+	if model == "" {
+		model = r.URL.Query().Get("model")
+	}
+	return received, model, nil
+}
+
+// tooLargeOr replaces errors from reading past the body's size limit with a 413.
+func tooLargeOr(err error, maxSize int64) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return uploadTooLarge(maxSize)
+	}
+	return err
+}
+
+// receiveMultipart receives the image field of a multipart form.
+func receiveMultipart(w http.ResponseWriter, r *http.Request, spoolDir string, maxSize int64) (*upload, string, error) {
+	// multipart framing and other fields are allowed a little over the image's limit
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+1<<20)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, "", requestError{Status: http.StatusBadRequest, Code: "malformed_upload", Message: "Malformed multipart/form-data upload"}
+	}
+
+	model := r.URL.Query().Get("model")
+	var received *upload
+	fail := func(err error) (*upload, string, error) {
+		if received != nil {
+			received.Close()
+		}
+		return nil, "", tooLargeOr(err, maxSize)
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if !errors.As(err, &tooLarge) {
+				err = requestError{Status: http.StatusBadRequest, Code: "malformed_upload", Message: "Malformed upload"}
+			}
+			return fail(err)
+		}
+		switch part.FormName() {
+		case "image":
+			if received != nil {
+				return fail(requestError{Status: http.StatusBadRequest, Code: "malformed_upload", Message: "Only one image may be uploaded"})
+			}
+			log.Printf("received file: %v", part.FileName())
+			received, err = spool(part, spoolDir, maxSize)
+			if err != nil {
+				return fail(err)
+			}
+		case "model":
+			value, err := io.ReadAll(io.LimitReader(part, maxFieldSize))
+			if err != nil {
+				return fail(err)
+			}
+			model = strings.TrimSpace(string(value))
+		}
+		part.Close()
+	}
+	if received == nil {
+		return nil, "", requestError{Status: http.StatusNotFound, Code: "file_not_found", Message: "File not found"}
+	}
+	return received, model, nil
+}
+
+// spool writes the image to a temporary file, sniffing its format from the first bytes and hashing it as it goes.
+func spool(image io.Reader, spoolDir string, maxSize int64) (*upload, error) {
+	head := make([]byte, sniffSize)
+	n, err := io.ReadFull(image, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+	if _, err := imaging.DetectFormat(bytes.NewReader(head)); err != nil {
+		return nil, err
+	}
+
+	file, err := os.CreateTemp(spoolDir, spoolPattern)
+	if err != nil {
+		return nil, fmt.Errorf("could not create upload file: %s", err)
+	}
+	received := &upload{File: file}
+	h := sha256.New()
+	// one byte over the limit is read so that oversized uploads can be told apart
+	written, err := io.Copy(io.MultiWriter(file, h), io.LimitReader(io.MultiReader(bytes.NewReader(head), image), maxSize+1))
+	if err != nil {
+		received.Close()
+		return nil, err
+	}
+	if written > maxSize {
+		received.Close()
+		return nil, uploadTooLarge(maxSize)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		received.Close()
+		return nil, fmt.Errorf("failed to reset file pointer: %v", err)
+	}
+	received.sum = h.Sum(nil)
+	return received, nil
+}
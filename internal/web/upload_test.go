@@ -0,0 +1,220 @@
+package web
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"imagetag/internal/jobs"
+	"imagetag/internal/tagging"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildRouter_Upload(t *testing.T) {
+	image := append(bytes.Clone(pngHeader), bytes.Repeat([]byte{0}, 100)...)
+
+	tests := map[string]struct {
+		build         func(t *testing.T) *http.Request
+		maxUploadSize int64
+		wantStatus    int
+		wantCode      string
+		wantModel     string
+	}{
+		"model after image": {
+			build: func(t *testing.T) *http.Request {
+				body := &bytes.Buffer{}
+				mw := multipart.NewWriter(body)
+				part, _ := mw.CreateFormFile("image", "image.png")
+				part.Write(image)
+				mw.WriteField("model", "model-b")
+				mw.Close()
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", body)
+				req.Header.Set("Content-Type", mw.FormDataContentType())
+				return req
+			},
+			wantStatus: http.StatusOK,
+			wantModel:  "model-b",
+		},
+		"model in query": {
+			build: func(t *testing.T) *http.Request {
+				return buildUploadRequest(t, "/api/v1/tag-image?model=model-c", "image", image)
+			},
+			wantStatus: http.StatusOK,
+			wantModel:  "model-c",
+		},
+		"too large": {
+			build: func(t *testing.T) *http.Request {
+				return buildUploadRequest(t, "/api/v1/tag-image", "image", image)
+			},
+			maxUploadSize: 64,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+			wantCode:      "upload_too_large",
+		},
+		"body too large": {
+			build: func(t *testing.T) *http.Request {
+				body := &bytes.Buffer{}
+				mw := multipart.NewWriter(body)
+				mw.WriteField("padding", strings.Repeat("x", 2<<20))
+				part, _ := mw.CreateFormFile("image", "image.png")
+				part.Write(image)
+				mw.Close()
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", body)
+				req.Header.Set("Content-Type", mw.FormDataContentType())
+				return req
+			},
+			maxUploadSize: 64,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+			wantCode:      "upload_too_large",
+		},
+		"unsupported": {
+			build: func(t *testing.T) *http.Request {
+				return buildUploadRequest(t, "/api/v1/tag-image", "image", []byte("plain text"))
+			},
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantCode:   "unsupported_format",
+		},
+		"missing content type": {
+			build: func(t *testing.T) *http.Request {
+				return httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", strings.NewReader("{}"))
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "malformed_upload",
+		},
+		"unsupported content type": {
+			build: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", strings.NewReader("cat"))
+				req.Header.Set("Content-Type", "text/plain")
+				return req
+			},
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantCode:   "unsupported_media_type",
+		},
+		"raw": {
+			build: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image?model=model-b", bytes.NewReader(image))
+				req.Header.Set("Content-Type", "image/png")
+				return req
+			},
+			wantStatus: http.StatusOK,
+			wantModel:  "model-b",
+		},
+		"raw too large": {
+			build: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", bytes.NewReader(image))
+				req.Header.Set("Content-Type", "image/png")
+				return req
+			},
+			maxUploadSize: 64,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+			wantCode:      "upload_too_large",
+		},
+		"raw not an image": {
+			build: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", strings.NewReader("plain text"))
+				req.Header.Set("Content-Type", "image/png")
+				return req
+			},
+			wantStatus: http.StatusUnsupportedMediaType,
+			wantCode:   "unsupported_format",
+		},
+		"base64": {
+			build: func(t *testing.T) *http.Request {
+				body, _ := json.Marshal(base64Upload{ImageBase64: base64.StdEncoding.EncodeToString(image), Model: "model-b"})
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			wantStatus: http.StatusOK,
+			wantModel:  "model-b",
+		},
+		"base64 too large": {
+			build: func(t *testing.T) *http.Request {
+				body, _ := json.Marshal(base64Upload{ImageBase64: base64.StdEncoding.EncodeToString(image)})
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			maxUploadSize: 64,
+			wantStatus:    http.StatusRequestEntityTooLarge,
+			wantCode:      "upload_too_large",
+		},
+		"base64 corrupt": {
+			build: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", strings.NewReader(`{"image_base64": "iVBORw0KGgo!!!!"}`))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "malformed_upload",
+		},
+		"base64 missing": {
+			build: func(t *testing.T) *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-image", strings.NewReader(`{"model": "model-b"}`))
+				req.Header.Set("Content-Type", "application/json")
+				return req
+			},
+			wantStatus: http.StatusNotFound,
+			wantCode:   "file_not_found",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tagger := &fakeTagger{result: tagging.JobResult{Tags: []string{"cat"}}}
+			r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute), MaxUploadSize: test.maxUploadSize})
+			req := test.build(t)
+			req.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, req)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.wantStatus, w.Body.String())
+			}
+			if test.wantCode != "" {
+				var got errorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("could not decode error: %v", err)
+				}
+				if got.Code != test.wantCode {
+					t.Errorf("got code %s, want %s", got.Code, test.wantCode)
+				}
+				return
+			}
+			if tagger.model != test.wantModel {
+				t.Errorf("got model %s, want %s", tagger.model, test.wantModel)
+			}
+			if want := sha256.Sum256(image); !bytes.Equal(tagger.sum, want[:]) {
+				t.Errorf("got hash %x, want %x", tagger.sum, want)
+			}
+		})
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir := t.TempDir()
+	image := append(bytes.Clone(pngHeader), bytes.Repeat([]byte{0}, 100)...)
+
+	received, err := spool(bytes.NewReader(image), dir, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filepath.Dir(received.Name()) != dir || !strings.HasPrefix(filepath.Base(received.Name()), ".staging-") {
+		t.Errorf("got spool file %s, want a staging file in %s", received.Name(), dir)
+	}
+	if sum := sha256.Sum256(image); !bytes.Equal(received.Sha256(), sum[:]) {
+		t.Error("got the wrong hash")
+	}
+
+	received.Close()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("spool file was not removed: %v", entries)
+	}
+}
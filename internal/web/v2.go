@@ -0,0 +1,52 @@
+package web
+
+import (
+	"imagetag/internal/tagging"
+	"time"
+)
+
+type tagV2 struct {
+	Name     string   `json:"name"`
+	Score    *float64 `json:"score,omitempty"`
+	Category string   `json:"category,omitempty"`
+}
+
+type timingV2 struct {
+	SubmittedAt time.Time `json:"submitted_at"`
+	CompletedAt time.Time `json:"completed_at"`
+	DurationMs  int64     `json:"duration_ms"`
+}
+
+// tagResponseV2 is the v2 response body.  Unlike v1's bare array of tag names it carries each tag's score and
+// category, along with details of the job which produced them.
+type tagResponseV2 struct {
+	JobId  string   `json:"job_id"`
+	Model  string   `json:"model"`
+	Format string   `json:"format"`
+	Tags   []tagV2  `json:"tags"`
+	Timing timingV2 `json:"timing"`
+	Cached bool     `json:"cached"`
+}
+
+func buildTagResponseV2(result tagging.JobResult) tagResponseV2 {
+	tags := make([]tagV2, 0, len(result.TagDetails))
+	for _, tag := range result.TagDetails {
+		tags = append(tags, tagV2{
+			Name:     tag.Name,
+			Score:    tag.Score,
+			Category: tag.Category,
+		})
+	}
+	return tagResponseV2{
+		JobId:  result.JobId,
+		Model:  result.Model,
+		Format: string(result.Format),
+		Tags:   tags,
+		Timing: timingV2{
+			SubmittedAt: result.SubmittedAt,
+			CompletedAt: result.CompletedAt,
+			DurationMs:  result.CompletedAt.Sub(result.SubmittedAt).Milliseconds(),
+		},
+		Cached: result.Cached,
+	}
+}
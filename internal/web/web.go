@@ -1,13 +1,19 @@
 package web
 
 import (
+	"context"
 	"embed"
 	"encoding/json"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"html/template"
+	"imagetag/internal/cache"
+	"imagetag/internal/fetch"
+	"imagetag/internal/jobs"
 	"imagetag/internal/tagging"
+	"imagetag/keythrottle"
 	"log"
+	"mime/multipart"
 	"net/http"
 	"strings"
 )
@@ -15,7 +21,57 @@ import (
 //go:embed templates/*
 var templateFs embed.FS
 
-func BuildRouter(interrogator *tagging.InterrogateForever) *chi.Mux {
+// Config holds the services the router is built on.
+type Config struct {
+	Tagger   tagging.Tagger
+	JobStore *jobs.Store
+	// Cache is purged by the admin endpoint.  It may be nil when results aren't cached.
+	Cache *cache.Cache
+	// AdminKey must be presented in an X-Admin-Key header to use the admin endpoints, which are refused when it's empty.
+	AdminKey string
+	// MaxUploadSize is the largest image upload accepted, in bytes, defaulting to DefaultMaxUploadSize.
+	MaxUploadSize int64
+	// SpoolDir is where uploads are written as they're received, defaulting to the system's temporary folder.  Uploads
+	// are copied from there into their job package, so it's best on the same filesystem as the input folder.
+	SpoolDir string
+	// MaxBatchItems is how many images one batch may hold, defaulting to DefaultMaxBatchItems.
+	MaxBatchItems int
+	// Fetcher downloads images for the tag-url endpoint.  One refusing internal addresses is used when it's nil.
+	Fetcher *fetch.Fetcher
+	// Auth authenticates the API endpoints by API key.  The API is open when its KeyStore is nil.
+	Auth keythrottle.AuthConfig
+	// Scheduler shares the backend fairly between customers, including async jobs.  Jobs are started as they're
+	// received when it's nil.
+	Scheduler *keythrottle.Scheduler
+	// RateLimiter refuses requests which submit images over their customer's rate with 429 before they're queued.
+	// Requests aren't limited when it's nil.
+	RateLimiter *keythrottle.RateLimiter
+}
+
+// maxTagUrlBodySize bounds the JSON body of the tag-url endpoint.
+const maxTagUrlBodySize = 16 << 10
+
+// tagUrlRequest is the JSON body of the tag-url endpoint.
+type tagUrlRequest struct {
+	Url   string `json:"url"`
+	Model string `json:"model"`
+}
+
+func BuildRouter(config Config) *chi.Mux {
+	tagger := config.Tagger
+	jobStore := config.JobStore
+	maxUploadSize := config.MaxUploadSize
+	if maxUploadSize <= 0 {
+		maxUploadSize = DefaultMaxUploadSize
+	}
+	maxBatchItems := config.MaxBatchItems
+	if maxBatchItems <= 0 {
+		maxBatchItems = DefaultMaxBatchItems
+	}
+	fetcher := config.Fetcher
+	if fetcher == nil {
+		fetcher = fetch.BuildFetcher(fetch.Config{MaxSize: maxUploadSize, MaxRedirects: fetch.DefaultMaxRedirects})
+	}
 
 	indexTmpl, err := template.ParseFS(templateFs, "templates/index.html")
 	if err != nil {
@@ -34,7 +90,13 @@ func BuildRouter(interrogator *tagging.InterrogateForever) *chi.Mux {
 	r.Use(middleware.StripSlashes)
 	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
 		data := struct {
-		}{}
+			Models []string
+			// ApiKeyRequired hides the form, which can't send an API key, when the API refuses requests without one
+			ApiKeyRequired bool
+		}{
+			Models:         tagger.AllowedModels(),
+			ApiKeyRequired: config.Auth.KeyStore != nil && config.Auth.Policy == keythrottle.AUTH_REJECT,
+		}
 
 		if err := indexTmpl.Execute(w, data); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -53,10 +115,13 @@ func BuildRouter(interrogator *tagging.InterrogateForever) *chi.Mux {
 		w.Header().Set("X-XSS-Protection", "1")
 		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
 		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Imagetag-Model", result.Model)
+		w.Header().Set("X-Imagetag-Cache", cacheStatus(result))
+		w.Header().Set("X-Imagetag-Format", string(result.Format))
 		if acceptsJson(acceptHeader) {
 			w.Header().Set("Content-Type", "application/json")
 			if result.Error != nil {
-				http.Error(w, result.Error.Error(), http.StatusInternalServerError)
+				writeJsonError(w, result.Error)
 				return
 			}
 
@@ -67,9 +132,17 @@ func BuildRouter(interrogator *tagging.InterrogateForever) *chi.Mux {
 		} else {
 			w.Header().Set("Content-Type", "text/html; charset=utf-8")
 			data := struct {
-				Tags []string
+				Tags  []string
+				Model string
+				Error *errorResponse
 			}{
-				Tags: result.Tags,
+				Tags:  result.Tags,
+				Model: result.Model,
+			}
+			if result.Error != nil {
+				status, body := describeError(result.Error)
+				data.Error = &body
+				w.WriteHeader(status)
 			}
 
 			if err := respTmpl.Execute(w, data); err != nil {
@@ -79,52 +152,212 @@ func BuildRouter(interrogator *tagging.InterrogateForever) *chi.Mux {
 
 	}
 
-	r.Post("/api/v1/tag-image", func(w http.ResponseWriter, r *http.Request) {
-		if err := r.ParseMultipartForm(10 << 20); err != nil { // Limit memory usage to 10MB
-			http.Error(w, "File too big or malformed", http.StatusBadRequest)
-			return
+	// tagFile submits the image and waits for the result.  A failed job is returned as a result with an Error, so that
+	// it may be rendered alongside the job's details.
+	tagFile := func(r *http.Request, file multipart.File, model string) (tagging.JobResult, error) {
+		// images which would be refused are refused before they wait for their turn
+		if err := tagger.Validate(file, model); err != nil {
+			return tagging.JobResult{}, err
 		}
-
-		file, fileHeader, err := r.FormFile("image")
-		log.Printf("received file: %v", fileHeader.Filename)
+		done, err := schedule(r, config.Scheduler)
 		if err != nil {
-			http.Error(w, "File not found", http.StatusNotFound)
-			return
+			return tagging.JobResult{}, err
 		}
-		defer file.Close()
-
-		c, cancel, err := interrogator.TagImage(file)
+		defer done()
+		submission, err := tagger.TagImage(file, model)
 		if err != nil {
-			log.Printf("Error creating tag image: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-			return
+			return tagging.JobResult{}, err
 		}
 		for {
 			select {
 			case <-r.Context().Done():
-				cancel()
+				submission.Cancel()
 				log.Println("client disconnected")
-				http.Error(w, "Client disconnected", http.StatusRequestTimeout)
-				return
-			case result := <-c:
+				return tagging.JobResult{}, r.Context().Err()
+			case result := <-submission.Results:
 				log.Printf("job result: %v", result)
-				if result.Error != nil {
-					http.Error(w, result.Error.Error(), http.StatusInternalServerError)
-					return
-				}
-				handleResults(w, r, result)
-				return
-
+				return result, nil
 			}
 
 		}
+	}
+
+	// tagUpload submits the uploaded image and waits for the result.
+	tagUpload := func(w http.ResponseWriter, r *http.Request) (tagging.JobResult, error) {
+		file, model, err := receiveUpload(w, r, config.SpoolDir, maxUploadSize)
+		if err != nil {
+			return tagging.JobResult{}, err
+		}
+		defer file.Close()
+		return tagFile(r, file, model)
+	}
+
+	// the admin endpoints are only open to the admin key, and not to the API's keys
+	r.With(requireAdminKey(config.AdminKey)).Delete("/api/v1/admin/cache", func(w http.ResponseWriter, r *http.Request) {
+		purged := 0
+		if config.Cache != nil {
+			purged = config.Cache.Purge()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			Purged int `json:"purged"`
+		}{
+			Purged: purged,
+		})
+	})
+
+	var apiMiddlewares []func(http.Handler) http.Handler
+	if config.Auth.KeyStore != nil {
+		apiMiddlewares = append(apiMiddlewares, keythrottle.Authenticate(config.Auth))
+	}
+	api := r.With(apiMiddlewares...)
+	// submit carries the routes which give the backend work, which are the only ones rate limited or throttled, so that
+	// polling a job neither uses up its customer's requests nor waits behind running tag requests.  Requests over the
+	// limit are refused before they wait for the throttle.
+	submit := api
+	if config.RateLimiter != nil {
+		submit = submit.With(config.RateLimiter.Limit)
+	}
+	if config.Auth.KeyStore != nil {
+		submit = submit.With(keythrottle.ThrottleUnauthenticated(config.Auth))
+	}
+
+	submit.Post("/api/v1/tag-image", func(w http.ResponseWriter, r *http.Request) {
+		result, err := tagUpload(w, r)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		handleResults(w, r, result)
+	})
+
+	submit.Post("/api/v2/tag-image", func(w http.ResponseWriter, r *http.Request) {
+		result, err := tagUpload(w, r)
+		writeTagResponseV2(w, result, err)
+	})
+
+	submit.Post("/api/v1/tag-url", func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxTagUrlBodySize)
+		var body tagUrlRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Url == "" {
+			writeJsonError(w, requestError{Status: http.StatusBadRequest, Code: "malformed_request", Message: `Expected a JSON body {"url": ..., "model": ...}`})
+			return
+		}
+		image, err := fetcher.Fetch(r.Context(), body.Url)
+		if err != nil {
+			writeJsonError(w, err)
+			return
+		}
+		defer image.Close()
+		log.Printf("fetched url: %v", body.Url)
+		file, err := spool(image, config.SpoolDir, maxUploadSize)
+		if err != nil {
+			writeJsonError(w, err)
+			return
+		}
+		defer file.Close()
+
+		result, err := tagFile(r, file, body.Model)
+		writeTagResponseV2(w, result, err)
+	})
+
+	submit.Post("/api/v1/tag-batch", func(w http.ResponseWriter, r *http.Request) {
+		tagBatch(w, r, tagger, config.Scheduler, config.SpoolDir, maxUploadSize, maxBatchItems)
+	})
+
+	submit.Post("/api/v1/jobs", func(w http.ResponseWriter, r *http.Request) {
+		file, model, err := receiveUpload(w, r, config.SpoolDir, maxUploadSize)
+		if err != nil {
+			writeJsonError(w, err)
+			return
+		}
+		if err := tagger.Validate(file, model); err != nil {
+			file.Close()
+			writeJsonError(w, err)
+			return
+		}
+		// the job is accepted straight away and waits for its turn with the backend after the response, so the store
+		// closes the upload
+		job := jobStore.Submit(file, model, scheduleJob(r, config.Scheduler))
+		w.Header().Set("Location", "/api/v1/jobs/"+job.Id)
+		writeJob(w, http.StatusAccepted, job)
+	})
+
+	api.Get("/api/v1/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		job, err := jobStore.Get(chi.URLParam(r, "id"))
+		if err != nil {
+			writeJsonError(w, requestError{Status: http.StatusNotFound, Code: "job_not_found", Message: err.Error()})
+			return
+		}
+		writeJob(w, http.StatusOK, job)
+	})
 
+	api.Delete("/api/v1/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if err := jobStore.Cancel(chi.URLParam(r, "id")); err != nil {
+			writeJsonError(w, requestError{Status: http.StatusNotFound, Code: "job_not_found", Message: err.Error()})
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
 	})
 
 	return r
 
 }
 
+// schedule waits for the request's turn to start a backend job.  The returned func must be called when the job is
+// finished.
+func schedule(r *http.Request, scheduler *keythrottle.Scheduler) (func(), error) {
+	if scheduler == nil {
+		return func() {}, nil
+	}
+	tier, _ := keythrottle.GetTier(r.Context())
+	mediator, err := scheduler.Wait(r.Context(), tier, keythrottle.CustomerId(r))
+	if err != nil {
+		return nil, err
+	}
+	return mediator.Done, nil
+}
+
+// scheduleJob builds the wait for an async job's turn with the backend, which outlives the request.  It's nil, for the
+// job to start straight away, when there's no scheduler.
+func scheduleJob(r *http.Request, scheduler *keythrottle.Scheduler) jobs.Turn {
+	if scheduler == nil {
+		return nil
+	}
+	tier, _ := keythrottle.GetTier(r.Context())
+	customer := keythrottle.CustomerId(r)
+	return func(ctx context.Context) (func(), error) {
+		mediator, err := scheduler.Wait(ctx, tier, customer)
+		if err != nil {
+			return nil, err
+		}
+		return mediator.Done, nil
+	}
+}
+
+// writeTagResponseV2 writes the result, or the error which prevented it, as a v2 response.
+func writeTagResponseV2(w http.ResponseWriter, result tagging.JobResult, err error) {
+	if err == nil {
+		err = result.Error
+	}
+	if err != nil {
+		writeJsonError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(buildTagResponseV2(result)); err != nil {
+		http.Error(w, "failed to encode JSON", http.StatusInternalServerError)
+	}
+}
+
+func cacheStatus(result tagging.JobResult) string {
+	if result.Cached {
+		return "hit"
+	}
+	return "miss"
+}
+
 func acceptsJson(acceptHeader string) bool {
 	parts := strings.Split(acceptHeader, ",")
 	for _, part := range parts {
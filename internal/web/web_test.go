@@ -0,0 +1,746 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"imagetag/internal/cache"
+	"imagetag/internal/fetch"
+	"imagetag/internal/imaging"
+	"imagetag/internal/jobs"
+	"imagetag/internal/tagging"
+	"imagetag/keythrottle"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pngHeader is enough of a png for content sniffing.
+var pngHeader = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+
+type fakeTagger struct {
+	result    tagging.JobResult
+	submitErr error
+	// validateErr is returned by Validate, before the image waits for its turn
+	validateErr error
+	cancelled   bool
+	model       string
+	// sum is the image's hash, when it was hashed as it was received
+	sum []byte
+}
+
+func (f *fakeTagger) TagImage(imageFile multipart.File, model string) (tagging.Submission, error) {
+	if f.submitErr != nil {
+		return tagging.Submission{}, f.submitErr
+	}
+	f.model = model
+	if hashed, ok := imageFile.(tagging.HashedFile); ok {
+		f.sum = hashed.Sha256()
+	}
+	c := make(chan tagging.JobResult, 1)
+	c <- f.result
+	return tagging.Submission{
+		JobId:   f.result.JobId,
+		Results: c,
+		Cancel:  func() { f.cancelled = true },
+	}, nil
+}
+
+func (f *fakeTagger) Validate(imageFile multipart.File, model string) error {
+	return f.validateErr
+}
+
+func (f *fakeTagger) AllowedModels() []string {
+	return []string{"model-a"}
+}
+
+func buildUploadRequest(t *testing.T, url string, fieldName string, content []byte) *http.Request {
+	t.Helper()
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	part, err := mw.CreateFormFile(fieldName, "image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	mw.Close()
+	req := httptest.NewRequest(http.MethodPost, url, body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+func TestBuildRouter_TagImage(t *testing.T) {
+	tests := map[string]struct {
+		tagger     *fakeTagger
+		fieldName  string
+		accept     string
+		wantStatus int
+		wantTags   []string
+		wantModel  string
+		wantError  *errorResponse
+		wantBody   string
+	}{
+		"json tags": {
+			tagger:     &fakeTagger{result: tagging.JobResult{Tags: []string{"cat", "outdoors"}, Model: "model-a"}},
+			fieldName:  "image",
+			accept:     "application/json",
+			wantStatus: http.StatusOK,
+			wantTags:   []string{"cat", "outdoors"},
+			wantModel:  "model-a",
+		},
+		"html tags": {
+			tagger:     &fakeTagger{result: tagging.JobResult{Tags: []string{"cat"}}},
+			fieldName:  "image",
+			accept:     "text/html",
+			wantStatus: http.StatusOK,
+		},
+		"job error": {
+			tagger:     &fakeTagger{result: tagging.JobResult{Error: errors.New("backend failed")}},
+			fieldName:  "image",
+			accept:     "application/json",
+			wantStatus: http.StatusInternalServerError,
+		},
+		"invalid image": {
+			tagger:     &fakeTagger{result: tagging.JobResult{Error: tagging.BackendError{Code: tagging.ERROR_INVALID_IMAGE, Message: "cannot identify image", JobId: "job-1"}}},
+			fieldName:  "image",
+			accept:     "application/json",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantError:  &errorResponse{Code: "invalid_image", Message: "cannot identify image", JobId: "job-1"},
+		},
+		"backend error": {
+			tagger:     &fakeTagger{result: tagging.JobResult{Error: tagging.BackendError{Code: tagging.ERROR_BACKEND, Message: "out of memory", JobId: "job-1"}}},
+			fieldName:  "image",
+			accept:     "application/json",
+			wantStatus: http.StatusBadGateway,
+			wantError:  &errorResponse{Code: "backend_error", Message: "out of memory", JobId: "job-1"},
+		},
+		"backend error html": {
+			tagger:     &fakeTagger{result: tagging.JobResult{Error: tagging.BackendError{Code: tagging.ERROR_BACKEND, Message: "out of memory", JobId: "job-1"}}},
+			fieldName:  "image",
+			accept:     "text/html",
+			wantStatus: http.StatusBadGateway,
+			wantBody:   "Tagging failed: out of memory (backend_error)",
+		},
+		"submit error": {
+			tagger:     &fakeTagger{submitErr: errors.New("unsupported file type")},
+			fieldName:  "image",
+			accept:     "application/json",
+			wantStatus: http.StatusInternalServerError,
+		},
+		"model not allowed": {
+			tagger:     &fakeTagger{submitErr: tagging.ModelNotAllowedError{Model: "model-z"}},
+			fieldName:  "image",
+			accept:     "application/json",
+			wantStatus: http.StatusBadRequest,
+		},
+		"image too large": {
+			tagger:     &fakeTagger{submitErr: imaging.ImageTooLargeError{Reason: "image is 60000x60000, the limit is 100000000 pixels"}},
+			fieldName:  "image",
+			accept:     "application/json",
+			wantStatus: http.StatusRequestEntityTooLarge,
+			wantError:  &errorResponse{Code: "image_too_large", Message: "image too large: image is 60000x60000, the limit is 100000000 pixels"},
+		},
+		"truncated image": {
+			tagger:     &fakeTagger{submitErr: imaging.InvalidImageError{Reason: "unexpected EOF"}},
+			fieldName:  "image",
+			accept:     "application/json",
+			wantStatus: http.StatusUnprocessableEntity,
+			wantError:  &errorResponse{Code: "invalid_image", Message: "invalid image: unexpected EOF"},
+		},
+		"missing file": {
+			tagger:     &fakeTagger{},
+			fieldName:  "not-image",
+			accept:     "application/json",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := BuildRouter(Config{Tagger: test.tagger, JobStore: jobs.BuildStore(test.tagger, time.Minute, time.Minute)})
+			req := buildUploadRequest(t, "/api/v1/tag-image", test.fieldName, pngHeader)
+			req.Header.Set("Accept", test.accept)
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, req)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.wantStatus, w.Body.String())
+			}
+			if test.wantTags != nil {
+				var tags []string
+				if err := json.Unmarshal(w.Body.Bytes(), &tags); err != nil {
+					t.Fatalf("could not decode response: %v", err)
+				}
+				if !reflect.DeepEqual(tags, test.wantTags) {
+					t.Errorf("got %v, want %v", tags, test.wantTags)
+				}
+			}
+			if test.wantError != nil {
+				var got errorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("could not decode error: %v", err)
+				}
+				if got != *test.wantError {
+					t.Errorf("got error %+v, want %+v", got, *test.wantError)
+				}
+			}
+			if !strings.Contains(w.Body.String(), test.wantBody) {
+				t.Errorf("got body %s, want it to contain %s", w.Body.String(), test.wantBody)
+			}
+			if got := w.Header().Get("X-Imagetag-Model"); got != test.wantModel {
+				t.Errorf("got model header %s, want %s", got, test.wantModel)
+			}
+		})
+	}
+}
+
+func TestBuildRouter_TagImageV2(t *testing.T) {
+	score := 0.9
+	submittedAt := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	tagger := &fakeTagger{result: tagging.JobResult{
+		JobId:       "job-1",
+		Tags:        []string{"cat", "general"},
+		TagDetails:  []tagging.Tag{{Name: "cat", Score: &score, Category: tagging.CATEGORY_GENERAL}, {Name: "general"}},
+		Model:       "model-a",
+		SubmittedAt: submittedAt,
+		CompletedAt: submittedAt.Add(1500 * time.Millisecond),
+	}}
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute)})
+	req := buildUploadRequest(t, "/api/v2/tag-image", "image", pngHeader)
+	w := httptest.NewRecorder()
+
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var got tagResponseV2
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	want := tagResponseV2{
+		JobId: "job-1",
+		Model: "model-a",
+		Tags:  []tagV2{{Name: "cat", Score: &score, Category: tagging.CATEGORY_GENERAL}, {Name: "general"}},
+		Timing: timingV2{
+			SubmittedAt: submittedAt,
+			CompletedAt: submittedAt.Add(1500 * time.Millisecond),
+			DurationMs:  1500,
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestBuildRouter_Jobs(t *testing.T) {
+	tagger := &fakeTagger{result: tagging.JobResult{JobId: "backend-1", Tags: []string{"cat"}, TagDetails: []tagging.Tag{{Name: "cat"}}}}
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute)})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, buildUploadRequest(t, "/api/v1/jobs", "image", pngHeader))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body.String())
+	}
+	var submitted jobResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &submitted); err != nil {
+		t.Fatalf("could not decode response: %v", err)
+	}
+	location := w.Header().Get("Location")
+	if location != "/api/v1/jobs/"+submitted.JobId {
+		t.Errorf("got location %s", location)
+	}
+
+	var polled jobResponse
+	deadline := time.Now().Add(time.Second)
+	for polled.Status != jobs.STATUS_COMPLETE && time.Now().Before(deadline) {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, location, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &polled); err != nil {
+			t.Fatalf("could not decode response: %v", err)
+		}
+	}
+	if polled.Status != jobs.STATUS_COMPLETE {
+		t.Fatalf("got status %s, want %s", polled.Status, jobs.STATUS_COMPLETE)
+	}
+	if polled.Result == nil || len(polled.Result.Tags) != 1 || polled.Result.Tags[0].Name != "cat" {
+		t.Errorf("got result %+v", polled.Result)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, location, nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, location, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestBuildRouter_PurgeCache(t *testing.T) {
+	resultCache, err := cache.BuildCache(10, time.Minute, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resultCache.Put("a", tagging.JobResult{Tags: []string{"cat"}})
+	tagger := &fakeTagger{}
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute), Cache: resultCache, AdminKey: "secret"})
+	purge := func(adminKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodDelete, "/api/v1/admin/cache", nil)
+		if adminKey != "" {
+			req.Header.Set("X-Admin-Key", adminKey)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, adminKey := range []string{"", "wrong"} {
+		if w := purge(adminKey); w.Code != http.StatusUnauthorized {
+			t.Errorf("admin key %q got status %d, want %d", adminKey, w.Code, http.StatusUnauthorized)
+		}
+	}
+	if resultCache.Len() != 1 {
+		t.Fatalf("cache was purged without the admin key")
+	}
+
+	w := purge("secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), `"purged":1`) {
+		t.Errorf("got body %s", w.Body.String())
+	}
+	if resultCache.Len() != 0 {
+		t.Errorf("got %d cached, want 0", resultCache.Len())
+	}
+}
+
+func TestBuildRouter_PurgeCache_Disabled(t *testing.T) {
+	tagger := &fakeTagger{}
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute)})
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/admin/cache", nil)
+	req.Header.Set("X-Admin-Key", "")
+	w := httptest.NewRecorder()
+
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestBuildRouter_Auth(t *testing.T) {
+	keyStore := keythrottle.BuildKeyStore()
+	if err := keyStore.SetTiers(keythrottle.AuthTierStorage{TierA: map[string]string{"appa": "aaaa"}, TierB: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	tagger := &fakeTagger{result: tagging.JobResult{Tags: []string{"cat"}}}
+	r := BuildRouter(Config{
+		Tagger:   tagger,
+		JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute),
+		Auth:     keythrottle.AuthConfig{KeyStore: keyStore, Policy: keythrottle.AUTH_REJECT},
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, buildUploadRequest(t, "/api/v2/tag-image", "image", pngHeader))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w = httptest.NewRecorder()
+	req := buildUploadRequest(t, "/api/v2/tag-image", "image", pngHeader)
+	req.Header.Set("Authorization", "Bearer aaaa")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	// the page is still served to browsers, without the form which can't send a key
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if strings.Contains(w.Body.String(), "<form") {
+		t.Error("the form was offered when an API key is required")
+	}
+}
+
+func TestBuildRouter_Auth_Admin(t *testing.T) {
+	keyStore := keythrottle.BuildKeyStore()
+	if err := keyStore.SetTiers(keythrottle.AuthTierStorage{TierA: map[string]string{"appa": "aaaa"}, TierB: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	tagger := &fakeTagger{}
+	r := BuildRouter(Config{
+		Tagger:   tagger,
+		JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute),
+		Auth:     keythrottle.AuthConfig{KeyStore: keyStore, Policy: keythrottle.AUTH_REJECT},
+		AdminKey: "secret",
+	})
+
+	// API keys don't open the admin endpoints
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodDelete, "/api/v1/admin/cache", nil)
+	req.Header.Set("Authorization", "Bearer aaaa")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// and the admin key needs no API key
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "/api/v1/admin/cache", nil)
+	req.Header.Set("X-Admin-Key", "secret")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+}
+
+func TestBuildRouter_Scheduler(t *testing.T) {
+	scheduler := keythrottle.BuildScheduler(keythrottle.SchedulerConfig{MaxConcurrent: 1})
+	tagger := &fakeTagger{result: tagging.JobResult{Tags: []string{"cat"}}}
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute), Scheduler: scheduler})
+
+	// another customer holds the only slot
+	holding, err := scheduler.Wait(context.Background(), keythrottle.TIER_A, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		r.ServeHTTP(w, buildUploadRequest(t, "/api/v2/tag-image", "image", pngHeader))
+		close(served)
+	}()
+	select {
+	case <-served:
+		t.Fatal("request was served while the backend was busy")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	holding.Done()
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatal("request was not served when the backend was free")
+	}
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if scheduler.Running() != 0 {
+		t.Errorf("got %d running, want 0", scheduler.Running())
+	}
+}
+
+func TestBuildRouter_Scheduler_ValidatesFirst(t *testing.T) {
+	scheduler := keythrottle.BuildScheduler(keythrottle.SchedulerConfig{MaxConcurrent: 1})
+	tagger := &fakeTagger{validateErr: imaging.InvalidImageError{Reason: "truncated"}}
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute), Scheduler: scheduler})
+
+	// another customer holds the only slot
+	holding, err := scheduler.Wait(context.Background(), keythrottle.TIER_A, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer holding.Done()
+
+	for _, url := range []string{"/api/v1/tag-image", "/api/v2/tag-image", "/api/v1/jobs"} {
+		w := httptest.NewRecorder()
+		served := make(chan struct{})
+		go func() {
+			req := buildUploadRequest(t, url, "image", pngHeader)
+			req.Header.Set("Accept", "application/json")
+			r.ServeHTTP(w, req)
+			close(served)
+		}()
+		select {
+		case <-served:
+		case <-time.After(time.Second):
+			t.Fatalf("%s: invalid image waited for the busy backend", url)
+		}
+		if w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: got status %d, want %d", url, w.Code, http.StatusUnprocessableEntity)
+		}
+	}
+}
+
+// pendingTagger is a tagger whose results arrive when the test sends them.
+type pendingTagger struct {
+	fakeTagger
+	results chan tagging.JobResult
+}
+
+func (p *pendingTagger) TagImage(imageFile multipart.File, model string) (tagging.Submission, error) {
+	return tagging.Submission{JobId: "job-1", Results: p.results, Cancel: func() {}}, nil
+}
+
+// waitForJob polls the store until the job has the wanted status.
+func waitForJob(t *testing.T, jobStore *jobs.Store, id string, want jobs.Status) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if job, err := jobStore.Get(id); err == nil && job.Status == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for job %s to be %s", id, want)
+}
+
+func TestBuildRouter_Scheduler_Jobs(t *testing.T) {
+	scheduler := keythrottle.BuildScheduler(keythrottle.SchedulerConfig{MaxConcurrent: 1})
+	tagger := &pendingTagger{results: make(chan tagging.JobResult, 1)}
+	jobStore := jobs.BuildStore(tagger, time.Minute, time.Minute)
+	r := BuildRouter(Config{Tagger: tagger, JobStore: jobStore, Scheduler: scheduler})
+
+	// both jobs are accepted straight away, though only one can run
+	var ids []string
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, buildUploadRequest(t, "/api/v1/jobs", "image", pngHeader))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body.String())
+		}
+		var response jobResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, response.JobId)
+		if i == 0 {
+			waitForJob(t, jobStore, ids[0], jobs.STATUS_PENDING)
+		}
+	}
+	if job, _ := jobStore.Get(ids[1]); job.Status != jobs.STATUS_QUEUED {
+		t.Errorf("got status %s for the second job, want %s", job.Status, jobs.STATUS_QUEUED)
+	}
+	// the pending job holds its turn
+	if scheduler.Running() != 1 {
+		t.Errorf("got %d running, want 1", scheduler.Running())
+	}
+
+	// cancelling the queued job withdraws it from the queue
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/api/v1/jobs/"+ids[1], nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+	waitForJob(t, jobStore, ids[1], jobs.STATUS_CANCELLED)
+
+	tagger.results <- tagging.JobResult{JobId: ids[0], Tags: []string{"cat"}}
+	waitForJob(t, jobStore, ids[0], jobs.STATUS_COMPLETE)
+	deadline := time.Now().Add(time.Second)
+	for scheduler.Running() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the finished job's turn was not freed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBuildRouter_RateLimit(t *testing.T) {
+	tagger := &fakeTagger{result: tagging.JobResult{Tags: []string{"cat"}}}
+	r := BuildRouter(Config{
+		Tagger:      tagger,
+		JobStore:    jobs.BuildStore(tagger, time.Minute, time.Minute),
+		RateLimiter: keythrottle.BuildRateLimiter(keythrottle.RateLimiterConfig{Limits: map[keythrottle.Tier]keythrottle.RateLimit{keythrottle.TIER_UNAUTHENTICATED: {PerMinute: 1, Burst: 1}}}),
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, buildUploadRequest(t, "/api/v2/tag-image", "image", pngHeader))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, buildUploadRequest(t, "/api/v2/tag-image", "image", pngHeader))
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Limit") != "1" {
+		t.Errorf("got headers %v", w.Header())
+	}
+}
+
+func TestBuildRouter_RateLimit_Polling(t *testing.T) {
+	tagger := &pendingTagger{results: make(chan tagging.JobResult, 1)}
+	r := BuildRouter(Config{
+		Tagger:      tagger,
+		JobStore:    jobs.BuildStore(tagger, time.Minute, time.Minute),
+		RateLimiter: keythrottle.BuildRateLimiter(keythrottle.RateLimiterConfig{Limits: map[keythrottle.Tier]keythrottle.RateLimit{keythrottle.TIER_UNAUTHENTICATED: {PerMinute: 1, Burst: 2}}}),
+	})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, buildUploadRequest(t, "/api/v1/jobs", "image", pngHeader))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body.String())
+	}
+	location := w.Header().Get("Location")
+
+	// polling the job isn't limited
+	for i := 0; i < 5; i++ {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, location, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("poll %d got status %d, want %d", i, w.Code, http.StatusOK)
+		}
+		if w.Header().Get("RateLimit-Limit") != "" {
+			t.Errorf("poll %d got rate limit headers %v", i, w.Header())
+		}
+	}
+
+	// and doesn't use up tokens, so the second submission still fits the burst
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, buildUploadRequest(t, "/api/v1/jobs", "image", pngHeader))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("got status %d, want %d: %s", w.Code, http.StatusAccepted, w.Body.String())
+	}
+	if w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("got headers %v", w.Header())
+	}
+}
+
+// startedTagger is a pendingTagger which signals each submission.
+type startedTagger struct {
+	*pendingTagger
+	started chan struct{}
+}
+
+func (s *startedTagger) TagImage(imageFile multipart.File, model string) (tagging.Submission, error) {
+	s.started <- struct{}{}
+	return s.pendingTagger.TagImage(imageFile, model)
+}
+
+// serveWithin serves the request, failing the test if it isn't answered in time.
+func serveWithin(t *testing.T, r http.Handler, req *http.Request, timeout time.Duration) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		r.ServeHTTP(w, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("%s %s was not answered in time", req.Method, req.URL.Path)
+	}
+	return w
+}
+
+func TestBuildRouter_RateLimit_Throttle(t *testing.T) {
+	keyStore := keythrottle.BuildKeyStore()
+	if err := keyStore.SetTiers(keythrottle.AuthTierStorage{TierA: map[string]string{"appa": "aaaa"}, TierB: map[string]string{}}); err != nil {
+		t.Fatal(err)
+	}
+	tagger := &startedTagger{pendingTagger: &pendingTagger{results: make(chan tagging.JobResult, 1)}, started: make(chan struct{}, 1)}
+	r := BuildRouter(Config{
+		Tagger:      tagger,
+		JobStore:    jobs.BuildStore(tagger, time.Minute, time.Minute),
+		Auth:        keythrottle.AuthConfig{KeyStore: keyStore, Policy: keythrottle.AUTH_THROTTLE, UnauthenticatedConcurrency: 1},
+		RateLimiter: keythrottle.BuildRateLimiter(keythrottle.RateLimiterConfig{Limits: map[keythrottle.Tier]keythrottle.RateLimit{keythrottle.TIER_UNAUTHENTICATED: {PerMinute: 1, Burst: 1}}}),
+	})
+
+	// an unauthenticated request holds the only throttle slot while it waits for its tags
+	tagged := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, buildUploadRequest(t, "/api/v2/tag-image", "image", pngHeader))
+		tagged <- w.Code
+	}()
+	<-tagger.started
+
+	// requests over the limit are refused without waiting for the throttle
+	w := serveWithin(t, r, buildUploadRequest(t, "/api/v1/jobs", "image", pngHeader), time.Second)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	// polling isn't throttled
+	w = serveWithin(t, r, httptest.NewRequest(http.MethodGet, "/api/v1/jobs/missing", nil), time.Second)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	tagger.results <- tagging.JobResult{JobId: "job-1", Tags: []string{"cat"}}
+	if code := <-tagged; code != http.StatusOK {
+		t.Errorf("got status %d for the throttled request, want %d", code, http.StatusOK)
+	}
+}
+
+func TestBuildRouter_TagUrl(t *testing.T) {
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngHeader)
+	}))
+	defer images.Close()
+
+	tests := map[string]struct {
+		fetcher    *fetch.Fetcher
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		"fetched": {
+			fetcher:    fetch.BuildFetcher(fetch.Config{AllowPrivate: true}),
+			body:       `{"url": "` + images.URL + `/cat.png", "model": "model-b"}`,
+			wantStatus: http.StatusOK,
+		},
+		"loopback refused": {
+			body:       `{"url": "` + images.URL + `/cat.png"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "url_not_allowed",
+		},
+		"missing url": {
+			body:       `{"model": "model-b"}`,
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "malformed_request",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			tagger := &fakeTagger{result: tagging.JobResult{JobId: "job-1", Tags: []string{"cat"}, TagDetails: []tagging.Tag{{Name: "cat"}}}}
+			r := BuildRouter(Config{Tagger: tagger, JobStore: jobs.BuildStore(tagger, time.Minute, time.Minute), Fetcher: test.fetcher})
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/tag-url", strings.NewReader(test.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+
+			r.ServeHTTP(w, req)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("got status %d, want %d: %s", w.Code, test.wantStatus, w.Body.String())
+			}
+			if test.wantCode != "" {
+				var got errorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+					t.Fatalf("could not decode error: %v", err)
+				}
+				if got.Code != test.wantCode {
+					t.Errorf("got code %s, want %s", got.Code, test.wantCode)
+				}
+				return
+			}
+			var got tagResponseV2
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("could not decode response: %v", err)
+			}
+			if got.JobId != "job-1" || tagger.model != "model-b" {
+				t.Errorf("got job %s with model %s, want job-1 with model-b", got.JobId, tagger.model)
+			}
+		})
+	}
+}
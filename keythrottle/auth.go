@@ -0,0 +1,151 @@
+package keythrottle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthPolicy says what to do with requests which don't present an API key.
+type AuthPolicy string
+
+// AUTH_ALLOW serves unauthenticated requests as TIER_UNAUTHENTICATED.
+const AUTH_ALLOW AuthPolicy = "allow"
+
+// AUTH_THROTTLE serves unauthenticated requests, but only a limited number at a time.
+const AUTH_THROTTLE AuthPolicy = "throttle"
+
+// AUTH_REJECT refuses unauthenticated requests with 401.
+const AUTH_REJECT AuthPolicy = "reject"
+
+// DefaultUnauthenticatedConcurrency is how many unauthenticated requests AUTH_THROTTLE serves at once.
+const DefaultUnauthenticatedConcurrency = 1
+
+func ParseAuthPolicy(value string) (AuthPolicy, error) {
+	switch policy := AuthPolicy(value); policy {
+	case AUTH_ALLOW, AUTH_THROTTLE, AUTH_REJECT:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown auth policy: %s", value)
+	}
+}
+
+type ctxKeyAuth int
+
+const TierKey ctxKeyAuth = 0
+const KeyNameKey ctxKeyAuth = 1
+
+// AuthConfig configures the Authenticate middleware.
+type AuthConfig struct {
+	KeyStore *KeyStore
+	Policy   AuthPolicy
+	// UnauthenticatedConcurrency is how many unauthenticated requests AUTH_THROTTLE serves at once, defaulting to
+	// DefaultUnauthenticatedConcurrency.
+	UnauthenticatedConcurrency int
+}
+
+// Authenticate builds middleware which reads the API key from an `Authorization: Bearer` or `X-API-Key` header, and
+// puts its tier and name into the request context.  Keys which aren't in the KeyStore are refused with 401, as are
+// requests without a key under AUTH_REJECT.  AUTH_THROTTLE is left to ThrottleUnauthenticated, so that requests can
+// be rate limited in between.
+func Authenticate(config AuthConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fh := func(w http.ResponseWriter, r *http.Request) {
+			key := readApiKey(r)
+			tier, name := config.KeyStore.GetKey(key)
+			if key != "" && tier == TIER_UNAUTHENTICATED {
+				writeUnauthorized(w, "invalid_api_key", "The API key is not recognized")
+				return
+			}
+			if tier == TIER_UNAUTHENTICATED && config.Policy == AUTH_REJECT {
+				writeUnauthorized(w, "unauthorized", "An API key is required")
+				return
+			}
+			ctx := context.WithValue(r.Context(), TierKey, tier)
+			ctx = context.WithValue(ctx, KeyNameKey, name)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		}
+		return http.HandlerFunc(fh)
+	}
+}
+
+// ThrottleUnauthenticated builds middleware which, under AUTH_THROTTLE, serves only UnauthenticatedConcurrency
+// requests without an API key at once.  The others wait for their turn, or give up when their client does.  It goes
+// after Authenticate, and every request is let through under the other policies.
+func ThrottleUnauthenticated(config AuthConfig) func(http.Handler) http.Handler {
+	concurrency := config.UnauthenticatedConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultUnauthenticatedConcurrency
+	}
+	// unauthenticated holds a token for each unauthenticated request being served
+	unauthenticated := make(chan struct{}, concurrency)
+	return func(next http.Handler) http.Handler {
+		fh := func(w http.ResponseWriter, r *http.Request) {
+			if tier, _ := GetTier(r.Context()); config.Policy == AUTH_THROTTLE && tier == TIER_UNAUTHENTICATED {
+				select {
+				case unauthenticated <- struct{}{}:
+					defer func() { <-unauthenticated }()
+				case <-r.Context().Done():
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fh)
+	}
+}
+
+// readApiKey returns the key from the Authorization bearer token, or else the X-API-Key header.
+func readApiKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		scheme, token, found := strings.Cut(auth, " ")
+		if found && strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+func writeUnauthorized(w http.ResponseWriter, code string, message string) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="imagetag"`)
+	writeJsonError(w, http.StatusUnauthorized, code, message)
+}
+
+// writeJsonError writes an error body shaped like the rest of the API's.
+func writeJsonError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{
+		Code:    code,
+		Message: message,
+	})
+}
+
+// GetTier returns the tier the Authenticate middleware found for the request.
+func GetTier(ctx context.Context) (Tier, error) {
+	if ctx == nil {
+		return TIER_UNAUTHENTICATED, errors.New("ctx is nil")
+	}
+	if tier, ok := ctx.Value(TierKey).(Tier); ok {
+		return tier, nil
+	}
+	return TIER_UNAUTHENTICATED, errors.New("not found")
+}
+
+// GetKeyName returns the name of the request's API key, which is empty for unauthenticated requests.
+func GetKeyName(ctx context.Context) (string, error) {
+	if ctx == nil {
+		return "", errors.New("ctx is nil")
+	}
+	if name, ok := ctx.Value(KeyNameKey).(string); ok {
+		return name, nil
+	}
+	return "", errors.New("not found")
+}
@@ -0,0 +1,156 @@
+package keythrottle
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func buildTestKeyStore(t *testing.T) *KeyStore {
+	t.Helper()
+	ks := BuildKeyStore()
+	err := ks.SetTiers(AuthTierStorage{
+		TierA: map[string]string{"appa": "aaaa"},
+		TierB: map[string]string{"one": "bbbb"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func TestAuthenticate(t *testing.T) {
+	tests := map[string]struct {
+		policy     AuthPolicy
+		headers    map[string]string
+		wantStatus int
+		wantTier   Tier
+		wantName   string
+	}{
+		"bearer tier a": {
+			policy:     AUTH_REJECT,
+			headers:    map[string]string{"Authorization": "Bearer aaaa"},
+			wantStatus: http.StatusOK,
+			wantTier:   TIER_A,
+			wantName:   "appa",
+		},
+		"x-api-key tier b": {
+			policy:     AUTH_REJECT,
+			headers:    map[string]string{"X-API-Key": "bbbb"},
+			wantStatus: http.StatusOK,
+			wantTier:   TIER_B,
+			wantName:   "one",
+		},
+		"unknown key": {
+			policy:     AUTH_ALLOW,
+			headers:    map[string]string{"X-API-Key": "zzzz"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		"non bearer authorization": {
+			policy:     AUTH_REJECT,
+			headers:    map[string]string{"Authorization": "Basic aaaa"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		"unauthenticated allowed": {
+			policy:     AUTH_ALLOW,
+			wantStatus: http.StatusOK,
+			wantTier:   TIER_UNAUTHENTICATED,
+		},
+		"unauthenticated throttled": {
+			policy:     AUTH_THROTTLE,
+			wantStatus: http.StatusOK,
+			wantTier:   TIER_UNAUTHENTICATED,
+		},
+		"unauthenticated rejected": {
+			policy:     AUTH_REJECT,
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			r := chi.NewRouter()
+			r.Use(Authenticate(AuthConfig{KeyStore: buildTestKeyStore(t), Policy: test.policy}))
+			var gotTier Tier
+			var gotName string
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				gotTier, _ = GetTier(r.Context())
+				gotName, _ = GetKeyName(r.Context())
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for k, v := range test.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+
+			if w.Code != test.wantStatus {
+				t.Fatalf("got status %d, want %d", w.Code, test.wantStatus)
+			}
+			if w.Code == http.StatusUnauthorized {
+				if w.Header().Get("WWW-Authenticate") == "" {
+					t.Errorf("missing WWW-Authenticate header")
+				}
+				return
+			}
+			if gotTier != test.wantTier {
+				t.Errorf("got tier %d, want %d", gotTier, test.wantTier)
+			}
+			if gotName != test.wantName {
+				t.Errorf("got name %q, want %q", gotName, test.wantName)
+			}
+		})
+	}
+}
+
+func TestThrottleUnauthenticated(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	config := AuthConfig{KeyStore: buildTestKeyStore(t), Policy: AUTH_THROTTLE, UnauthenticatedConcurrency: 1}
+	handler := Authenticate(config)(ThrottleUnauthenticated(config)(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started <- struct{}{}
+			<-release
+		})))
+
+	go handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	<-started
+
+	// a second unauthenticated request waits for the first, and gives up when its client does
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		close(done)
+	}()
+	select {
+	case <-started:
+		t.Fatal("second unauthenticated request was served concurrently")
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("second unauthenticated request did not give up")
+	}
+
+	// authenticated requests aren't held back
+	authed := httptest.NewRequest(http.MethodGet, "/", nil)
+	authed.Header.Set("X-API-Key", "aaaa")
+	go handler.ServeHTTP(httptest.NewRecorder(), authed)
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("authenticated request was throttled")
+	}
+	close(release)
+}
+
+func TestParseAuthPolicy(t *testing.T) {
+	if _, err := ParseAuthPolicy("reject"); err != nil {
+		t.Errorf("got error %v", err)
+	}
+	if _, err := ParseAuthPolicy("open"); err == nil {
+		t.Errorf("expected an error")
+	}
+}
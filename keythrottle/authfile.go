@@ -0,0 +1,257 @@
+package keythrottle
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultAuthFile is where the API keys are read from.
+const DefaultAuthFile = "data/auth.json"
+
+// DefaultAuthSettleInterval is how long the auth file must go unchanged before it's reloaded, so that an editor's
+// several writes are read once.
+const DefaultAuthSettleInterval = 250 * time.Millisecond
+
+// ErrNoAuthKeys is returned for an auth file which is empty or holds no keys.
+var ErrNoAuthKeys = errors.New("no keys are configured")
+
+// authFile is the layout of the auth file.  The tiers are read as raw json so that duplicate names can be found.
+type authFile struct {
+	TierA json.RawMessage `json:"tier_a"`
+	TierB json.RawMessage `json:"tier_b"`
+}
+
+// LoadAuthFile reads and validates the API keys in the file.
+func LoadAuthFile(path string) (AuthTierStorage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return AuthTierStorage{}, fmt.Errorf("could not read %s: %w", path, err)
+	}
+	tiers, err := ParseAuthTiers(data)
+	if err != nil {
+		return AuthTierStorage{}, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return tiers, nil
+}
+
+// ParseAuthTiers parses and validates the json of an auth file.
+func ParseAuthTiers(data []byte) (AuthTierStorage, error) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return AuthTierStorage{}, ErrNoAuthKeys
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var file authFile
+	if err := decoder.Decode(&file); err != nil {
+		return AuthTierStorage{}, err
+	}
+	tierA, err := parseTier("tier_a", file.TierA)
+	if err != nil {
+		return AuthTierStorage{}, err
+	}
+	tierB, err := parseTier("tier_b", file.TierB)
+	if err != nil {
+		return AuthTierStorage{}, err
+	}
+	tiers := AuthTierStorage{TierA: tierA, TierB: tierB}
+	if err := ValidateTiers(tiers); err != nil {
+		return AuthTierStorage{}, err
+	}
+	return tiers, nil
+}
+
+// parseTier reads a tier's object of names to keys, refusing names which appear more than once.
+func parseTier(tier string, raw json.RawMessage) (map[string]string, error) {
+	if raw == nil || bytes.Equal(raw, []byte("null")) {
+		return nil, fmt.Errorf("%s is missing", tier)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil, fmt.Errorf("%s must be an object of names to keys", tier)
+	}
+	keys := map[string]string{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", tier, err)
+		}
+		name := token.(string)
+		var key string
+		if err := decoder.Decode(&key); err != nil {
+			return nil, fmt.Errorf("%s: the key of %s must be a string", tier, name)
+		}
+		if _, exists := keys[name]; exists {
+			return nil, fmt.Errorf("%s: %s is listed more than once", tier, name)
+		}
+		keys[name] = key
+	}
+	return keys, nil
+}
+
+// ValidateTiers checks that every key is set and belongs to only one name, and that there's at least one key.
+func ValidateTiers(tiers AuthTierStorage) error {
+	if tiers.TierA == nil {
+		return errors.New("tier_a is missing")
+	}
+	if tiers.TierB == nil {
+		return errors.New("tier_b is missing")
+	}
+	if len(tiers.TierA) == 0 && len(tiers.TierB) == 0 {
+		return ErrNoAuthKeys
+	}
+	tierAKeys := map[string]string{}
+	if err := checkKeys("tier_a", tiers.TierA, tierAKeys); err != nil {
+		return err
+	}
+	tierBKeys := map[string]string{}
+	if err := checkKeys("tier_b", tiers.TierB, tierBKeys); err != nil {
+		return err
+	}
+	for key, name := range tierBKeys {
+		if nameA, exists := tierAKeys[key]; exists {
+			return fmt.Errorf("the key of tier_a %s is also the key of tier_b %s", nameA, name)
+		}
+	}
+	return nil
+}
+
+// checkKeys checks a tier's names and keys, collecting its keys by name.
+func checkKeys(tier string, names map[string]string, keys map[string]string) error {
+	for name, key := range names {
+		if name == "" {
+			return fmt.Errorf("%s has a key without a name", tier)
+		}
+		if key == "" {
+			return fmt.Errorf("%s: %s has an empty key", tier, name)
+		}
+		if other, exists := keys[key]; exists {
+			return fmt.Errorf("%s: %s and %s have the same key", tier, other, name)
+		}
+		keys[key] = name
+	}
+	return nil
+}
+
+// AuthFileWatcher keeps a KeyStore up to date with an auth file.  An invalid edit leaves the previous keys in place.
+type AuthFileWatcher struct {
+	Path     string
+	KeyStore *KeyStore
+	// Required makes Start fail when the file is missing or holds no keys.  Otherwise the KeyStore is left empty until
+	// keys are written to it.
+	Required bool
+	// SettleInterval is how long the file must go unchanged before it's reloaded, defaulting to
+	// DefaultAuthSettleInterval.
+	SettleInterval time.Duration
+	watcher        *fsnotify.Watcher
+	stop           chan struct{}
+	stopped        sync.WaitGroup
+	stopOnce       sync.Once
+}
+
+func BuildAuthFileWatcher(keyStore *KeyStore, path string) *AuthFileWatcher {
+	return &AuthFileWatcher{
+		Path:     path,
+		KeyStore: keyStore,
+	}
+}
+
+// Start loads the auth file into the KeyStore and watches it for changes.  It fails if the file isn't valid, or if it's
+// missing or holds no keys when it's Required.
+func (a *AuthFileWatcher) Start() error {
+	if a.SettleInterval <= 0 {
+		a.SettleInterval = DefaultAuthSettleInterval
+	}
+	a.Path = filepath.Clean(a.Path)
+	if err := a.load(); err != nil {
+		if a.Required || !(errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrNoAuthKeys)) {
+			return err
+		}
+		log.Printf("no API keys, waiting for them to be written: %s", err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("could not create watcher: %s", err)
+	}
+	// The folder is watched rather than the file, so that edits which replace the file are seen.
+	dir := filepath.Dir(a.Path)
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		if a.Required || !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("could not watch %s: %s", dir, err)
+		}
+		log.Printf("not watching for API keys, %s doesn't exist", dir)
+		return nil
+	}
+	a.watcher = watcher
+	a.stop = make(chan struct{})
+
+	a.stopped.Add(1)
+	go a.watch()
+	return nil
+}
+
+// Stop stops watching the auth file.  The KeyStore keeps the last keys loaded.  It's safe to call more than once.
+func (a *AuthFileWatcher) Stop() {
+	a.stopOnce.Do(func() {
+		if a.watcher == nil {
+			return
+		}
+		close(a.stop)
+		a.stopped.Wait()
+		if err := a.watcher.Close(); err != nil {
+			log.Printf("could not close watcher: %s", err)
+		}
+	})
+}
+
+func (a *AuthFileWatcher) load() error {
+	tiers, err := LoadAuthFile(a.Path)
+	if err != nil {
+		return err
+	}
+	if err := a.KeyStore.SetTiers(tiers); err != nil {
+		return err
+	}
+	log.Printf("loaded %d tier_a and %d tier_b keys from %s", len(tiers.TierA), len(tiers.TierB), a.Path)
+	return nil
+}
+
+func (a *AuthFileWatcher) watch() {
+	defer a.stopped.Done()
+	settle := time.NewTimer(a.SettleInterval)
+	settle.Stop()
+	defer settle.Stop()
+	for {
+		select {
+		case <-a.stop:
+			return
+		case event, ok := <-a.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) == a.Path && !event.Has(fsnotify.Chmod) {
+				settle.Reset(a.SettleInterval)
+			}
+		case err, ok := <-a.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watcher error: %s", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				settle.Reset(a.SettleInterval)
+			}
+		case <-settle.C:
+			if err := a.load(); err != nil {
+				log.Printf("keeping the previous API keys: %s", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package keythrottle
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseAuthTiers(t *testing.T) {
+	tests := map[string]struct {
+		json    string
+		wantErr bool
+	}{
+		"valid": {
+			json: `{"tier_a": {"appa": "aaaa"}, "tier_b": {"one": "bbbb", "two": "cccc"}}`,
+		},
+		"one tier empty": {
+			json: `{"tier_a": {"appa": "aaaa"}, "tier_b": {}}`,
+		},
+		"both tiers empty": {
+			json:    `{"tier_a": {}, "tier_b": {}}`,
+			wantErr: true,
+		},
+		"tier missing": {
+			json:    `{"tier_a": {"appa": "aaaa"}}`,
+			wantErr: true,
+		},
+		"tier null": {
+			json:    `{"tier_a": {"appa": "aaaa"}, "tier_b": null}`,
+			wantErr: true,
+		},
+		"unknown field": {
+			json:    `{"tier_a": {"appa": "aaaa"}, "tier_b": {}, "tier_c": {}}`,
+			wantErr: true,
+		},
+		"duplicate name": {
+			json:    `{"tier_a": {"appa": "aaaa", "appa": "dddd"}, "tier_b": {}}`,
+			wantErr: true,
+		},
+		"duplicate key in a tier": {
+			json:    `{"tier_a": {"appa": "aaaa", "appb": "aaaa"}, "tier_b": {}}`,
+			wantErr: true,
+		},
+		"key in both tiers": {
+			json:    `{"tier_a": {"appa": "aaaa"}, "tier_b": {"one": "aaaa"}}`,
+			wantErr: true,
+		},
+		"empty key": {
+			json:    `{"tier_a": {"appa": ""}, "tier_b": {}}`,
+			wantErr: true,
+		},
+		"key not a string": {
+			json:    `{"tier_a": {"appa": 1}, "tier_b": {}}`,
+			wantErr: true,
+		},
+		"malformed": {
+			json:    `{"tier_a": {"appa": "aaaa"}`,
+			wantErr: true,
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseAuthTiers([]byte(test.json))
+			if (err != nil) != test.wantErr {
+				t.Errorf("ParseAuthTiers() error = %v, wantErr %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadAuthFile_Repo(t *testing.T) {
+	tiers, err := LoadAuthFile(filepath.Join("..", DefaultAuthFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tiers.TierA) == 0 || len(tiers.TierB) == 0 {
+		t.Errorf("got %d tier_a and %d tier_b keys", len(tiers.TierA), len(tiers.TierB))
+	}
+}
+
+func waitForTier(t *testing.T, ks *KeyStore, key string, want Tier) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for ks.GetTierFromKey(key) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("key %s never became tier %d", key, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAuthFileWatcher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	write := func(json string) {
+		t.Helper()
+		// replaced the way editors do, by renaming a new file over it
+		staging := path + ".tmp"
+		if err := os.WriteFile(staging, []byte(json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(staging, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"tier_a": {"appa": "aaaa"}, "tier_b": {}}`)
+
+	ks := BuildKeyStore()
+	watcher := BuildAuthFileWatcher(ks, path)
+	watcher.SettleInterval = 10 * time.Millisecond
+	if err := watcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+	if tier, name := ks.GetKey("aaaa"); tier != TIER_A || name != "appa" {
+		t.Fatalf("got tier %d name %s, want tier_a appa", tier, name)
+	}
+
+	write(`{"tier_a": {}, "tier_b": {"appa": "aaaa", "one": "bbbb"}}`)
+	waitForTier(t, ks, "bbbb", TIER_B)
+	if tier := ks.GetTierFromKey("aaaa"); tier != TIER_B {
+		t.Errorf("got tier %d, want tier_b", tier)
+	}
+
+	// a bad edit keeps the previous keys
+	write(`{"tier_a": {"appa": "aaaa"}, "tier_b": {"one": "aaaa"}}`)
+	time.Sleep(200 * time.Millisecond)
+	if tier := ks.GetTierFromKey("bbbb"); tier != TIER_B {
+		t.Errorf("got tier %d, want tier_b", tier)
+	}
+
+	write(`{"tier_a": {"new": "nnnn"}, "tier_b": {}}`)
+	waitForTier(t, ks, "nnnn", TIER_A)
+	if tier := ks.GetTierFromKey("bbbb"); tier != TIER_UNAUTHENTICATED {
+		t.Errorf("got tier %d, want unauthenticated", tier)
+	}
+}
+
+func TestAuthFileWatcher_InvalidAtStart(t *testing.T) {
+	tests := map[string]struct {
+		content  string
+		missing  bool
+		required bool
+		wantErr  bool
+	}{
+		"no keys when required": {content: `{"tier_a": {}, "tier_b": {}}`, required: true, wantErr: true},
+		"empty when required":   {content: "", required: true, wantErr: true},
+		"missing when required": {missing: true, required: true, wantErr: true},
+		"no keys":               {content: `{"tier_a": {}, "tier_b": {}}`},
+		"empty":                 {content: ""},
+		"missing":               {missing: true},
+		"invalid":               {content: `{"tier_a": {}`, wantErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "auth.json")
+			if !test.missing {
+				if err := os.WriteFile(path, []byte(test.content), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			watcher := BuildAuthFileWatcher(BuildKeyStore(), path)
+			watcher.Required = test.required
+			err := watcher.Start()
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, wantErr %v", err, test.wantErr)
+			}
+			watcher.Stop()
+		})
+	}
+}
+
+func TestAuthFileWatcher_WaitsForFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	ks := BuildKeyStore()
+	watcher := BuildAuthFileWatcher(ks, path)
+	watcher.SettleInterval = 10 * time.Millisecond
+	if err := watcher.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Stop()
+
+	if err := os.WriteFile(path, []byte(`{"tier_a": {"appa": "aaaa"}, "tier_b": {}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	waitForTier(t, ks, "aaaa", TIER_A)
+
+	// Stop is safe to call again
+	watcher.Stop()
+	watcher.Stop()
+}
+
+func TestAuthFileWatcher_MissingFolder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "missing", "auth.json")
+	watcher := BuildAuthFileWatcher(BuildKeyStore(), path)
+	if err := watcher.Start(); err != nil {
+		t.Errorf("got error %v", err)
+	}
+	watcher.Stop()
+
+	watcher = BuildAuthFileWatcher(BuildKeyStore(), path)
+	watcher.Required = true
+	if err := watcher.Start(); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -17,8 +17,10 @@ type AuthTierStorage struct {
 }
 type KeyStore struct {
 	// Maps of empty strucks are incredibly fast.  It'll be a hashmap of 0 byte size objects.
-	tierA     map[string]struct{}
-	tierB     map[string]struct{}
+	tierA map[string]struct{}
+	tierB map[string]struct{}
+	// names maps each key to its name in the AuthTierStorage, for logging and per-customer bookkeeping.
+	names     map[string]string
 	tierMutex sync.Mutex
 }
 
@@ -26,6 +28,7 @@ func BuildKeyStore() *KeyStore {
 	return &KeyStore{
 		tierA:     make(map[string]struct{}),
 		tierB:     make(map[string]struct{}),
+		names:     make(map[string]string),
 		tierMutex: sync.Mutex{},
 	}
 }
@@ -37,22 +40,43 @@ func (kt *KeyStore) SetTiers(tiers AuthTierStorage) error {
 	if tiers.TierA == nil {
 		return fmt.Errorf("tier_a is nil")
 	}
+	newNames := make(map[string]string)
 	newTierA := make(map[string]struct{})
-	for _, key := range tiers.TierA {
+	for name, key := range tiers.TierA {
 		newTierA[key] = struct{}{}
+		newNames[key] = name
 	}
 	newTierB := make(map[string]struct{})
-	for _, key := range tiers.TierB {
+	for name, key := range tiers.TierB {
 		newTierB[key] = struct{}{}
+		newNames[key] = name
 	}
 	kt.tierMutex.Lock()
 	kt.tierA = newTierA
 	kt.tierB = newTierB
+	kt.names = newNames
 	kt.tierMutex.Unlock()
 	return nil
 }
 
 func (kt *KeyStore) GetTierFromKey(key string) Tier {
+	kt.tierMutex.Lock()
+	defer kt.tierMutex.Unlock()
+	return kt.getTierFromKey(key)
+}
+
+// GetKey returns the key's tier and its name.  Keys which aren't known are TIER_UNAUTHENTICATED, with no name.
+func (kt *KeyStore) GetKey(key string) (Tier, string) {
+	kt.tierMutex.Lock()
+	defer kt.tierMutex.Unlock()
+	tier := kt.getTierFromKey(key)
+	if tier == TIER_UNAUTHENTICATED {
+		return tier, ""
+	}
+	return tier, kt.names[key]
+}
+
+func (kt *KeyStore) getTierFromKey(key string) Tier {
 	if key == "" {
 		return TIER_UNAUTHENTICATED
 	}
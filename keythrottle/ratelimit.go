@@ -0,0 +1,209 @@
+package keythrottle
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultIdleTimeout is how long a customer's limiter is kept after its last request.
+const DefaultIdleTimeout = 10 * time.Minute
+
+// RateLimit is a token bucket: a customer may make Burst requests at once, refilled at PerMinute requests a minute.
+type RateLimit struct {
+	PerMinute float64
+	Burst     int
+}
+
+// DefaultRateLimits are the limits for each tier when they're not configured.
+var DefaultRateLimits = map[Tier]RateLimit{
+	TIER_A:               {PerMinute: 120, Burst: 30},
+	TIER_B:               {PerMinute: 30, Burst: 10},
+	TIER_UNAUTHENTICATED: {PerMinute: 10, Burst: 5},
+}
+
+// ParseRateLimits reads limits such as tier_a=120:30,tier_b=30:10, each a rate a minute and a burst.  A rate of 0
+// leaves the tier unlimited.  Tiers which aren't listed keep their DefaultRateLimits.
+func ParseRateLimits(value string) (map[Tier]RateLimit, error) {
+	limits := map[Tier]RateLimit{}
+	for tier, limit := range DefaultRateLimits {
+		limits[tier] = limit
+	}
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, limitValue, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("expected tier=rate:burst, got %s", item)
+		}
+		rateValue, burstValue, found := strings.Cut(limitValue, ":")
+		if !found {
+			return nil, fmt.Errorf("expected tier=rate:burst, got %s", item)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(rateValue), 64)
+		if err != nil || rate < 0 {
+			return nil, fmt.Errorf("invalid rate for %s: %s", name, rateValue)
+		}
+		burst, err := strconv.Atoi(strings.TrimSpace(burstValue))
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid burst for %s: %s", name, burstValue)
+		}
+		known := false
+		for _, t := range tierNames {
+			if t.name == strings.TrimSpace(name) {
+				limits[t.tier] = RateLimit{PerMinute: rate, Burst: burst}
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown tier: %s", name)
+		}
+	}
+	return limits, nil
+}
+
+// RateLimiterConfig configures the RateLimiter.
+type RateLimiterConfig struct {
+	// Limits is each tier's limit, defaulting to DefaultRateLimits.
+	Limits map[Tier]RateLimit
+	// IdleTimeout is how long a customer's limiter is kept after its last request, defaulting to DefaultIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// bucket is a customer's tokens as of updated.
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateDecision is whether a request was allowed, and the state of its customer's limit.
+type RateDecision struct {
+	Allowed bool
+	// Limit is the burst, the most requests which may be made at once
+	Limit int
+	// Remaining is how many more requests may be made now
+	Remaining int
+	// Reset is how long until the limit is fully refilled
+	Reset time.Duration
+	// RetryAfter is how long until another request may be made, when it wasn't allowed
+	RetryAfter time.Duration
+}
+
+// RateLimiter limits each customer's request rate with a token bucket sized by its tier.  Limiters of customers who
+// have been idle for the IdleTimeout are evicted.
+type RateLimiter struct {
+	limits      map[Tier]RateLimit
+	idleTimeout time.Duration
+	buckets     map[string]*bucket
+	lastSweep   time.Time
+	mutex       sync.Mutex
+	// now is the clock, replaced in tests
+	now func() time.Time
+}
+
+func BuildRateLimiter(config RateLimiterConfig) *RateLimiter {
+	limits := config.Limits
+	if limits == nil {
+		limits = DefaultRateLimits
+	}
+	idleTimeout := config.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultIdleTimeout
+	}
+	return &RateLimiter{
+		limits:      limits,
+		idleTimeout: idleTimeout,
+		buckets:     make(map[string]*bucket),
+		lastSweep:   time.Now(),
+		now:         time.Now,
+	}
+}
+
+// Allow takes a token from the customer's bucket if there's one left.  Tiers without a rate are always allowed.
+func (l *RateLimiter) Allow(tier Tier, customer string) RateDecision {
+	limit := l.limits[tier]
+	if limit.PerMinute <= 0 {
+		return RateDecision{Allowed: true}
+	}
+	perSecond := limit.PerMinute / 60
+	burst := float64(limit.Burst)
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.now()
+	l.evictIdle(now)
+	b, exists := l.buckets[customer]
+	if !exists {
+		b = &bucket{tokens: burst, updated: now}
+		l.buckets[customer] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.updated).Seconds()*perSecond)
+	b.updated = now
+
+	decision := RateDecision{Limit: limit.Burst}
+	if b.tokens >= 1 {
+		b.tokens--
+		decision.Allowed = true
+	} else {
+		decision.RetryAfter = secondsDuration((1 - b.tokens) / perSecond)
+	}
+	decision.Remaining = int(math.Floor(b.tokens))
+	decision.Reset = secondsDuration((burst - b.tokens) / perSecond)
+	return decision
+}
+
+// evictIdle forgets the buckets of customers idle for the idleTimeout, at most once each idleTimeout.  It must be
+// called with the mutex held.
+func (l *RateLimiter) evictIdle(now time.Time) {
+	if now.Sub(l.lastSweep) < l.idleTimeout {
+		return
+	}
+	for customer, b := range l.buckets {
+		if now.Sub(b.updated) >= l.idleTimeout {
+			delete(l.buckets, customer)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Len returns how many customers' limiters are kept.
+func (l *RateLimiter) Len() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.buckets)
+}
+
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Limit builds middleware which refuses requests over their customer's rate limit with 429.  Customers are identified
+// by CustomerId, so it must follow the Authenticate middleware for keys to be limited by their tier.
+func (l *RateLimiter) Limit(next http.Handler) http.Handler {
+	fh := func(w http.ResponseWriter, r *http.Request) {
+		tier, _ := GetTier(r.Context())
+		decision := l.Allow(tier, CustomerId(r))
+		if decision.Limit > 0 {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(decision.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+		}
+		if !decision.Allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(decision.RetryAfter)))
+			writeJsonError(w, http.StatusTooManyRequests, "rate_limited", "Too many requests, retry later")
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fh)
+}
+
+// ceilSeconds rounds the duration up to whole seconds, as the rate limit headers are.
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
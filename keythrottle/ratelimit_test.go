@@ -0,0 +1,147 @@
+package keythrottle
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock which only moves when it's told to.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func buildTestRateLimiter(limits map[Tier]RateLimit) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+	l := BuildRateLimiter(RateLimiterConfig{Limits: limits, IdleTimeout: time.Minute})
+	l.now = clock.Now
+	l.lastSweep = clock.now
+	return l, clock
+}
+
+func TestRateLimiter_Allow(t *testing.T) {
+	l, clock := buildTestRateLimiter(map[Tier]RateLimit{TIER_A: {PerMinute: 60, Burst: 2}})
+
+	for i := 0; i < 2; i++ {
+		if d := l.Allow(TIER_A, "a"); !d.Allowed {
+			t.Fatalf("request %d within the burst was refused", i)
+		}
+	}
+	d := l.Allow(TIER_A, "a")
+	if d.Allowed {
+		t.Fatal("request over the burst was allowed")
+	}
+	if d.Limit != 2 || d.Remaining != 0 || d.RetryAfter != time.Second || d.Reset != 2*time.Second {
+		t.Errorf("got %+v", d)
+	}
+
+	// other customers have their own bucket
+	if d := l.Allow(TIER_A, "b"); !d.Allowed {
+		t.Error("another customer was refused")
+	}
+
+	// a token is refilled each second
+	clock.now = clock.now.Add(time.Second)
+	if d := l.Allow(TIER_A, "a"); !d.Allowed {
+		t.Error("request after the refill was refused")
+	}
+	if d := l.Allow(TIER_A, "a"); d.Allowed {
+		t.Error("request beyond the refill was allowed")
+	}
+
+	// tiers without a rate aren't limited
+	for i := 0; i < 10; i++ {
+		if d := l.Allow(TIER_B, "c"); !d.Allowed {
+			t.Fatal("unlimited tier was refused")
+		}
+	}
+}
+
+func TestRateLimiter_EvictsIdle(t *testing.T) {
+	l, clock := buildTestRateLimiter(map[Tier]RateLimit{TIER_A: {PerMinute: 60, Burst: 2}})
+	l.Allow(TIER_A, "a")
+	clock.now = clock.now.Add(30 * time.Second)
+	l.Allow(TIER_A, "b")
+	if l.Len() != 2 {
+		t.Fatalf("got %d limiters, want 2", l.Len())
+	}
+
+	clock.now = clock.now.Add(45 * time.Second)
+	l.Allow(TIER_A, "b")
+	if l.Len() != 1 {
+		t.Errorf("got %d limiters, want 1", l.Len())
+	}
+}
+
+func TestRateLimiter_Limit(t *testing.T) {
+	l, _ := buildTestRateLimiter(map[Tier]RateLimit{
+		TIER_A:               {PerMinute: 60, Burst: 5},
+		TIER_UNAUTHENTICATED: {PerMinute: 60, Burst: 1},
+	})
+	r := chi.NewRouter()
+	r.Use(l.Limit)
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+
+	serve := func(remoteAddr string, tier Tier) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		if tier != TIER_UNAUTHENTICATED {
+			ctx := context.WithValue(req.Context(), TierKey, tier)
+			req = req.WithContext(context.WithValue(ctx, KeyNameKey, "appa"))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("192.0.2.1:1000", TIER_UNAUTHENTICATED)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("RateLimit-Limit") != "1" || w.Header().Get("RateLimit-Remaining") != "0" || w.Header().Get("RateLimit-Reset") != "1" {
+		t.Errorf("got headers %v", w.Header())
+	}
+
+	// unauthenticated clients are limited by address, whatever their port
+	w = serve("192.0.2.1:2000", TIER_UNAUTHENTICATED)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Errorf("got Retry-After %s", w.Header().Get("Retry-After"))
+	}
+	if w := serve("192.0.2.2:1000", TIER_UNAUTHENTICATED); w.Code != http.StatusOK {
+		t.Errorf("another address got status %d", w.Code)
+	}
+
+	// keys are limited by their tier, not their address
+	w = serve("192.0.2.1:3000", TIER_A)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("RateLimit-Limit") != "5" || w.Header().Get("RateLimit-Remaining") != "4" {
+		t.Errorf("got headers %v", w.Header())
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := ParseRateLimits("tier_a=600:100, unauthenticated=0:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[TIER_A] != (RateLimit{PerMinute: 600, Burst: 100}) || limits[TIER_B] != DefaultRateLimits[TIER_B] || limits[TIER_UNAUTHENTICATED].PerMinute != 0 {
+		t.Errorf("got %v", limits)
+	}
+	for _, value := range []string{"tier_c=1:1", "tier_a=1", "tier_a=-1:1", "tier_a=1:0", "tier_a=x:1"} {
+		if _, err := ParseRateLimits(value); err == nil {
+			t.Errorf("expected an error for %s", value)
+		}
+	}
+}
@@ -0,0 +1,318 @@
+package keythrottle
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxConcurrent is how many backend jobs the Scheduler runs at once.
+const DefaultMaxConcurrent = 4
+
+// DefaultMaxWait is how long a request may wait before it's executed ahead of the tiers' shares.
+const DefaultMaxWait = 30 * time.Second
+
+// DefaultTierWeights gives TIER_A four turns for each of TIER_B's, and unauthenticated requests only what's left over.
+var DefaultTierWeights = map[Tier]int{
+	TIER_A:               4,
+	TIER_B:               1,
+	TIER_UNAUTHENTICATED: 0,
+}
+
+// tierNames are the tiers' names in configuration, in the order they're visited.
+var tierNames = []struct {
+	tier Tier
+	name string
+}{
+	{TIER_A, "tier_a"},
+	{TIER_B, "tier_b"},
+	{TIER_UNAUTHENTICATED, "unauthenticated"},
+}
+
+// ParseTierWeights reads weights such as tier_a=4,tier_b=1,unauthenticated=0.  Tiers which aren't listed keep their
+// DefaultTierWeights.
+func ParseTierWeights(value string) (map[Tier]int, error) {
+	weights := map[Tier]int{}
+	for tier, weight := range DefaultTierWeights {
+		weights[tier] = weight
+	}
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		name, weightValue, found := strings.Cut(item, "=")
+		if !found {
+			return nil, fmt.Errorf("expected tier=weight, got %s", item)
+		}
+		weight, err := strconv.Atoi(strings.TrimSpace(weightValue))
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("invalid weight for %s: %s", name, weightValue)
+		}
+		known := false
+		for _, t := range tierNames {
+			if t.name == strings.TrimSpace(name) {
+				weights[t.tier] = weight
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown tier: %s", name)
+		}
+	}
+	return weights, nil
+}
+
+// SchedulerConfig configures the Scheduler.
+type SchedulerConfig struct {
+	// MaxConcurrent is how many requests may execute at once, defaulting to DefaultMaxConcurrent.
+	MaxConcurrent int
+	// Weights is each tier's share of the backend, defaulting to DefaultTierWeights.  Tiers weighted 0 are only served
+	// when the weighted tiers have nothing waiting.
+	Weights map[Tier]int
+	// MaxWait is how long a request may wait before it's executed ahead of the tiers' shares, so that the lowest tiers
+	// still make progress under sustained load.  It defaults to DefaultMaxWait, and is disabled when negative.
+	MaxWait time.Duration
+}
+
+// tierQueue is the customers of one tier.
+type tierQueue struct {
+	tier   Tier
+	weight int
+	// deficit is how many more requests the tier may execute in its current turn
+	deficit int
+	// order is the customers in the order they're visited.  next is where the next visit starts.
+	order []string
+	next  int
+}
+
+// scheduledCustomer is a customer's queue, and how many of its requests are executing.
+type scheduledCustomer struct {
+	queue  *ConnectedCustomer
+	active int
+}
+
+// Scheduler queues requests per customer, and shares the backend between the tiers by deficit round-robin, in
+// proportion to their weights.  Within a tier the customers take turns, so that a customer with many requests can't
+// starve the others.  Requests which have waited longer than MaxWait go first.  At most MaxConcurrent requests are
+// executing at once.
+type Scheduler struct {
+	maxConcurrent int
+	maxWait       time.Duration
+	running       int
+	customers     map[string]*scheduledCustomer
+	tiers         []*tierQueue
+	// tierIndex is the tier whose turn it is
+	tierIndex int
+	mutex     sync.Mutex
+}
+
+func BuildScheduler(config SchedulerConfig) *Scheduler {
+	maxConcurrent := config.MaxConcurrent
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrent
+	}
+	maxWait := config.MaxWait
+	if maxWait == 0 {
+		maxWait = DefaultMaxWait
+	}
+	weights := config.Weights
+	if weights == nil {
+		weights = DefaultTierWeights
+	}
+	s := &Scheduler{
+		maxConcurrent: maxConcurrent,
+		maxWait:       maxWait,
+		customers:     make(map[string]*scheduledCustomer),
+	}
+	for _, t := range tierNames {
+		s.tiers = append(s.tiers, &tierQueue{tier: t.tier, weight: weights[t.tier]})
+	}
+	return s
+}
+
+// Enqueue queues a request for the customer in the tier.  The handler must wait on the mediator's ExecuteChan before
+// starting its backend job, and call Done when the job is finished or when it gives up waiting.
+func (s *Scheduler) Enqueue(ctx context.Context, tier Tier, customer string) *HandlerMediator {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c, exists := s.customers[customer]
+	if !exists {
+		c = &scheduledCustomer{queue: BuildConnectedCustomer()}
+		s.customers[customer] = c
+		tq := s.tierQueue(tier)
+		tq.order = append(tq.order, customer)
+	}
+	m := c.queue.AddRequest(ctx)
+	m.done = func() {
+		if c.queue.Withdraw(m) {
+			s.release(c)
+		}
+	}
+	s.dispatch()
+	return m
+}
+
+// Wait queues a request for the customer and blocks until it may execute.  The returned mediator's Done must be called
+// when the backend job is finished.  If the context ends first the request is withdrawn and the context's error is
+// returned.
+func (s *Scheduler) Wait(ctx context.Context, tier Tier, customer string) (*HandlerMediator, error) {
+	m := s.Enqueue(ctx, tier, customer)
+	select {
+	case <-m.ExecuteChan:
+		return m, nil
+	case <-ctx.Done():
+		m.Done()
+		return nil, ctx.Err()
+	}
+}
+
+// Running returns how many requests are executing.
+func (s *Scheduler) Running() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.running
+}
+
+func (s *Scheduler) release(c *scheduledCustomer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.running--
+	c.active--
+	s.dispatch()
+}
+
+// tierQueue returns the tier's queue.  Unknown tiers are treated as unauthenticated.
+func (s *Scheduler) tierQueue(tier Tier) *tierQueue {
+	for _, tq := range s.tiers {
+		if tq.tier == tier {
+			return tq
+		}
+	}
+	return s.tierQueue(TIER_UNAUTHENTICATED)
+}
+
+// dispatch executes queued requests while there's capacity.  Customers with nothing queued or executing are
+// forgotten.  It must be called with the mutex held.
+func (s *Scheduler) dispatch() {
+	for s.running < s.maxConcurrent {
+		executed := s.dispatchStarved(time.Now()) || s.dispatchWeighted()
+		s.forgetIdle()
+		if !executed {
+			return
+		}
+	}
+}
+
+// dispatchStarved executes the longest waiting request if it has waited longer than maxWait.
+func (s *Scheduler) dispatchStarved(now time.Time) bool {
+	if s.maxWait < 0 {
+		return false
+	}
+	var oldest *scheduledCustomer
+	var oldestAt time.Time
+	for _, c := range s.customers {
+		queuedAt, waiting := c.queue.OldestQueuedAt()
+		if waiting && now.Sub(queuedAt) > s.maxWait && (oldest == nil || queuedAt.Before(oldestAt)) {
+			oldest = c
+			oldestAt = queuedAt
+		}
+	}
+	return oldest != nil && s.execute(oldest)
+}
+
+// dispatchWeighted executes a request by deficit round-robin between the weighted tiers.  Each tier's turn lets it
+// execute as many requests as its weight, and tiers with nothing waiting give up the rest of their turn.  When the
+// weighted tiers have nothing waiting, the tiers weighted 0 are served in order.
+func (s *Scheduler) dispatchWeighted() bool {
+	for visited := 0; visited < len(s.tiers); visited++ {
+		tq := s.tiers[s.tierIndex]
+		if tq.weight > 0 {
+			if tq.deficit <= 0 {
+				tq.deficit += tq.weight
+			}
+			if s.dispatchTier(tq) {
+				tq.deficit--
+				if tq.deficit <= 0 {
+					s.tierIndex = (s.tierIndex + 1) % len(s.tiers)
+				}
+				return true
+			}
+			// idle tiers don't save up their share
+			tq.deficit = 0
+		}
+		s.tierIndex = (s.tierIndex + 1) % len(s.tiers)
+	}
+	for _, tq := range s.tiers {
+		if tq.weight == 0 && s.dispatchTier(tq) {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatchTier executes a request from the next of the tier's customers which has one waiting.
+func (s *Scheduler) dispatchTier(tq *tierQueue) bool {
+	for i := 0; i < len(tq.order); i++ {
+		index := (tq.next + i) % len(tq.order)
+		if s.execute(s.customers[tq.order[index]]) {
+			tq.next = index + 1
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scheduler) execute(c *scheduledCustomer) bool {
+	if err := c.queue.TryExecute(); err != nil {
+		return false
+	}
+	s.running++
+	c.active++
+	return true
+}
+
+// forgetIdle removes customers with nothing queued or executing, keeping each tier's next pointing at the same
+// customer.  Customers with requests executing are kept so that they keep their place in the rotation.
+func (s *Scheduler) forgetIdle() {
+	for _, tq := range s.tiers {
+		kept := tq.order[:0]
+		next := 0
+		for i, customer := range tq.order {
+			c := s.customers[customer]
+			if c.queue.Len() == 0 && c.active == 0 {
+				delete(s.customers, customer)
+				continue
+			}
+			if i < tq.next {
+				next++
+			}
+			kept = append(kept, customer)
+		}
+		tq.order = kept
+		// next may be past the end, so that customers added later are visited before the rotation starts again
+		tq.next = next
+	}
+}
+
+// CustomerId identifies who the request is scheduled for: the name of its API key, or its client address when it's
+// unauthenticated.
+func CustomerId(r *http.Request) string {
+	tier, _ := GetTier(r.Context())
+	name, _ := GetKeyName(r.Context())
+	switch tier {
+	case TIER_A:
+		return "tier_a:" + name
+	case TIER_B:
+		return "tier_b:" + name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
@@ -0,0 +1,218 @@
+package keythrottle
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// executed returns the mediator which was signaled to execute, or nil if none were.
+func executed(mediators ...*HandlerMediator) *HandlerMediator {
+	for _, m := range mediators {
+		select {
+		case <-m.ExecuteChan:
+			return m
+		default:
+		}
+	}
+	return nil
+}
+
+func TestScheduler_LimitsConcurrency(t *testing.T) {
+	s := BuildScheduler(SchedulerConfig{MaxConcurrent: 2})
+	ctx := context.Background()
+	first := s.Enqueue(ctx, TIER_A, "a")
+	second := s.Enqueue(ctx, TIER_A, "a")
+	third := s.Enqueue(ctx, TIER_A, "a")
+
+	if got := executed(first); got != first {
+		t.Fatal("first request was not executed")
+	}
+	if got := executed(second); got != second {
+		t.Fatal("second request was not executed")
+	}
+	if got := executed(third); got != nil {
+		t.Fatal("third request was executed over the limit")
+	}
+	if s.Running() != 2 {
+		t.Errorf("got %d running, want 2", s.Running())
+	}
+
+	first.Done()
+	if got := executed(third); got != third {
+		t.Fatal("third request was not executed when a slot was freed")
+	}
+	// Done is safe to call again
+	first.Done()
+	if s.Running() != 2 {
+		t.Errorf("got %d running, want 2", s.Running())
+	}
+}
+
+func TestScheduler_RoundRobin(t *testing.T) {
+	s := BuildScheduler(SchedulerConfig{MaxConcurrent: 1})
+	ctx := context.Background()
+	running := s.Enqueue(ctx, TIER_A, "heavy")
+	heavy := []*HandlerMediator{s.Enqueue(ctx, TIER_A, "heavy"), s.Enqueue(ctx, TIER_A, "heavy"), s.Enqueue(ctx, TIER_A, "heavy")}
+	light := s.Enqueue(ctx, TIER_A, "light")
+	if executed(running) != running {
+		t.Fatal("first request was not executed")
+	}
+
+	// light is served after heavy's running request, ahead of heavy's backlog
+	running.Done()
+	if executed(light) != light {
+		t.Fatal("light customer was starved")
+	}
+	light.Done()
+	for i, m := range heavy {
+		if executed(m) != m {
+			t.Fatalf("heavy request %d was not executed in order", i)
+		}
+		m.Done()
+	}
+	if s.Running() != 0 {
+		t.Errorf("got %d running, want 0", s.Running())
+	}
+	if len(s.customers) != 0 || len(s.tiers[0].order) != 0 {
+		t.Errorf("idle customers were not forgotten: %v", s.tiers[0].order)
+	}
+}
+
+func TestScheduler_Wait(t *testing.T) {
+	s := BuildScheduler(SchedulerConfig{MaxConcurrent: 1})
+	holding, err := s.Wait(context.Background(), TIER_A, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a request which gives up waiting doesn't take a slot
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := s.Wait(ctx, TIER_A, "b"); err == nil {
+		t.Fatal("expected the wait to time out")
+	}
+	holding.Done()
+	if s.Running() != 0 {
+		t.Errorf("got %d running, want 0", s.Running())
+	}
+
+	next, err := s.Wait(context.Background(), TIER_A, "c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Done()
+}
+
+func TestCustomerId(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	if got := CustomerId(r); got != "ip:192.0.2.1" {
+		t.Errorf("got %s", got)
+	}
+	ctx := context.WithValue(r.Context(), TierKey, Tier(TIER_A))
+	ctx = context.WithValue(ctx, KeyNameKey, "appa")
+	if got := CustomerId(r.WithContext(ctx)); got != "tier_a:appa" {
+		t.Errorf("got %s", got)
+	}
+}
+
+// runDispatches executes and finishes requests one at a time, returning which customer each was for.
+func runDispatches(t *testing.T, s *Scheduler, queued map[string][]*HandlerMediator, count int) []string {
+	t.Helper()
+	var served []string
+	for i := 0; i < count; i++ {
+		found := false
+		for customer, mediators := range queued {
+			for _, m := range mediators {
+				if executed(m) == m {
+					served = append(served, customer)
+					m.Done()
+					found = true
+					break
+				}
+			}
+			if found {
+				break
+			}
+		}
+		if !found {
+			t.Fatalf("nothing was executed after %v", served)
+		}
+	}
+	return served
+}
+
+func TestScheduler_TierWeights(t *testing.T) {
+	s := BuildScheduler(SchedulerConfig{MaxConcurrent: 1, Weights: map[Tier]int{TIER_A: 4, TIER_B: 1}})
+	ctx := context.Background()
+	// holds the only slot while the backlog is queued
+	holding := s.Enqueue(ctx, TIER_B, "hold")
+	queued := map[string][]*HandlerMediator{}
+	for i := 0; i < 10; i++ {
+		queued["a"] = append(queued["a"], s.Enqueue(ctx, TIER_A, "a"))
+		queued["b"] = append(queued["b"], s.Enqueue(ctx, TIER_B, "b"))
+		queued["anon"] = append(queued["anon"], s.Enqueue(ctx, TIER_UNAUTHENTICATED, "anon"))
+	}
+	if executed(holding) != holding {
+		t.Fatal("first request was not executed")
+	}
+	holding.Done()
+
+	served := runDispatches(t, s, queued, 10)
+	counts := map[string]int{}
+	for _, customer := range served {
+		counts[customer]++
+	}
+	if counts["a"] != 8 || counts["b"] != 2 || counts["anon"] != 0 {
+		t.Errorf("got %v, want 8 a, 2 b and no anon: %v", counts, served)
+	}
+
+	// unauthenticated requests are served once the weighted tiers are idle
+	served = runDispatches(t, s, queued, 20)
+	if served[len(served)-1] != "anon" {
+		t.Errorf("got %v", served)
+	}
+	for _, customer := range served[:10] {
+		if customer == "anon" {
+			t.Fatalf("unauthenticated request was served while others were waiting: %v", served)
+		}
+	}
+}
+
+func TestScheduler_Starvation(t *testing.T) {
+	s := BuildScheduler(SchedulerConfig{MaxConcurrent: 1, MaxWait: 20 * time.Millisecond})
+	ctx := context.Background()
+	holding := s.Enqueue(ctx, TIER_A, "a")
+	anon := s.Enqueue(ctx, TIER_UNAUTHENTICATED, "anon")
+	queued := []*HandlerMediator{s.Enqueue(ctx, TIER_A, "a"), s.Enqueue(ctx, TIER_A, "a")}
+
+	time.Sleep(30 * time.Millisecond)
+	holding.Done()
+	if executed(anon) != anon {
+		t.Fatal("starved request was not executed first")
+	}
+	anon.Done()
+	for _, m := range queued {
+		if executed(m) != m {
+			t.Fatal("request was not executed")
+		}
+		m.Done()
+	}
+}
+
+func TestParseTierWeights(t *testing.T) {
+	weights, err := ParseTierWeights("tier_a=8, unauthenticated=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if weights[TIER_A] != 8 || weights[TIER_B] != 1 || weights[TIER_UNAUTHENTICATED] != 1 {
+		t.Errorf("got %v", weights)
+	}
+	for _, value := range []string{"tier_c=1", "tier_a", "tier_a=-1", "tier_a=x"} {
+		if _, err := ParseTierWeights(value); err == nil {
+			t.Errorf("expected an error for %s", value)
+		}
+	}
+}
@@ -2,23 +2,39 @@ package keythrottle
 
 import (
 	"context"
-	"log"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 var nextQueuedRequestid uint64 = 0
 
 type HandlerMediator struct {
 	ExecuteChan chan struct{}
+	request     *QueuedRequest
+	// done is called once by Done, when it's set
+	done     func()
+	doneOnce sync.Once
+}
+
+// Done tells the scheduler the handler is finished with the request, whether it was executed or given up on while
+// it was queued.  It may be called more than once.
+func (m *HandlerMediator) Done() {
+	if m.done != nil {
+		m.doneOnce.Do(m.done)
+	}
 }
 
 type QueuedRequest struct {
 	ID uint64
+	// QueuedAt is when the request was added to the queue
+	QueuedAt time.Time
 	// executeChannel is signaled when it is time to handle the request
 	executeChannel chan struct{}
 	// isCancelled notes that the request has been cancelled
-	isCancelled             bool
+	isCancelled bool
+	// executed notes that the request has been signaled to execute.  It's guarded by the ConnectedCustomer's mutex.
+	executed                bool
 	cancelledMutex          sync.Mutex
 	stoppedListeningExecute chan struct{}
 }
@@ -26,20 +42,19 @@ type QueuedRequest struct {
 func (qr *QueuedRequest) IsCancelled() bool {
 	qr.cancelledMutex.Lock()
 	defer qr.cancelledMutex.Unlock()
-	log.Println("checking if cancelled:", qr.isCancelled)
 	return qr.isCancelled
 }
 
 func (qr *QueuedRequest) SetCancelled() {
 	qr.cancelledMutex.Lock()
 	defer qr.cancelledMutex.Unlock()
-	log.Println("setting cancelled:", qr.isCancelled)
 	qr.isCancelled = true
 }
 
 func (q *QueuedRequest) BuildMediator() *HandlerMediator {
 	m := HandlerMediator{
 		ExecuteChan: q.executeChannel,
+		request:     q,
 	}
 	return &m
 }
@@ -83,7 +98,8 @@ func (c *ConnectedCustomer) AddRequest(ctx context.Context) *HandlerMediator {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	q := QueuedRequest{
-		ID: atomic.AddUint64(&nextQueuedRequestid, 1),
+		ID:       atomic.AddUint64(&nextQueuedRequestid, 1),
+		QueuedAt: time.Now(),
 	}
 	q.Init()
 	go func() {
@@ -123,6 +139,7 @@ func (c *ConnectedCustomer) TryExecute() error {
 	if foundIndex != -1 {
 		foundRequest := c.queuedRequests[foundIndex]
 		foundRequest.SignalExecute()
+		foundRequest.executed = true
 		c.queuedRequests = removeByIndex(c.queuedRequests, foundIndex)
 		return nil
 	}
@@ -130,6 +147,44 @@ func (c *ConnectedCustomer) TryExecute() error {
 	return RequestNotFoundError{}
 }
 
+// Len returns how many requests are queued, including cancelled requests which haven't been removed yet.
+func (c *ConnectedCustomer) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.queuedRequests)
+}
+
+// OldestQueuedAt returns when the longest waiting request which isn't cancelled was queued.  It returns false when
+// nothing is waiting.
+func (c *ConnectedCustomer) OldestQueuedAt() (time.Time, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, q := range c.queuedRequests {
+		if !q.IsCancelled() {
+			return q.QueuedAt, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Withdraw removes the mediator's request from the queue, so that it won't be executed.  It returns true if the
+// request had already been executed.
+func (c *ConnectedCustomer) Withdraw(m *HandlerMediator) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if m.request.executed {
+		return true
+	}
+	for i, qr := range c.queuedRequests {
+		if qr.ID == m.request.ID {
+			c.queuedRequests = removeByIndex(c.queuedRequests, i)
+			break
+		}
+	}
+	m.request.SetCancelled()
+	return false
+}
+
 func removeByIndex[T any](s []T, index int) []T {
 	if index < 0 || index >= len(s) {
 		return s // Index out of range; return the original slice